@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/shipengqi/lighting-i/pkg/cache"
+	"github.com/shipengqi/lighting-i/pkg/utils"
+)
+
+type CacheConfig struct {
+	Dir     string
+	MaxSize string
+	MaxAge  time.Duration
+	DryRun  bool
+}
+
+var cacheConfig CacheConfig
+
+func cacheCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   _defaultCacheCommand,
+		Short: "Manage the shared blob cache.",
+		Run: func(cmd *cobra.Command, args []string) {
+			_ = cmd.Help()
+		},
+	}
+	cmd.PersistentFlags().StringVar(&cacheConfig.Dir, "cache-dir", _defaultCacheDir, "Shared blob cache directory path.")
+	cmd.AddCommand(cacheLsCommand())
+	cmd.AddCommand(cacheDuCommand())
+	cmd.AddCommand(cachePruneCommand())
+	return cmd
+}
+
+func cacheLsCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "ls",
+		Short: "List the cached blobs, the least recently used first.",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := openCache()
+			entries, err := c.List()
+			if err != nil {
+				fmt.Printf("list cache %v\n", err)
+				os.Exit(1)
+			}
+			w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "DIGEST\tSIZE\tLAST USED")
+			for _, e := range entries {
+				fmt.Fprintf(w, "%s\t%s\t%s ago\n", e.Digest, utils.HumanSize(e.Size), time.Since(e.ModTime).Round(time.Second))
+			}
+			_ = w.Flush()
+		},
+	}
+}
+
+func cacheDuCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "du",
+		Short: "Show the disk usage of the cache.",
+		Run: func(cmd *cobra.Command, args []string) {
+			c := openCache()
+			size, count, err := c.Du()
+			if err != nil {
+				fmt.Printf("disk usage %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%s\t%d blob(s)\t%s\n", utils.HumanSize(size), count, c.Dir)
+		},
+	}
+}
+
+func cachePruneCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the blobs exceeding the size or age limit.",
+		Run: func(cmd *cobra.Command, args []string) {
+			maxSize := int64(-1)
+			if cacheConfig.MaxSize != "" {
+				s, err := utils.ParseSize(cacheConfig.MaxSize)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+				maxSize = s
+			}
+			if maxSize < 0 && cacheConfig.MaxAge <= 0 {
+				fmt.Println("At least one of '--max-size' and '--max-age' is required.")
+				os.Exit(1)
+			}
+			c := openCache()
+			pruned, err := c.Prune(maxSize, cacheConfig.MaxAge, cacheConfig.DryRun)
+			var freed int64
+			for _, e := range pruned {
+				freed += e.Size
+				if cacheConfig.DryRun {
+					fmt.Printf("would delete: %s\n", e.Digest)
+					continue
+				}
+				fmt.Printf("deleted: %s\n", e.Digest)
+			}
+			if cacheConfig.DryRun {
+				fmt.Printf("Would reclaim: %s\n", utils.HumanSize(freed))
+			} else {
+				fmt.Printf("Total reclaimed space: %s\n", utils.HumanSize(freed))
+			}
+			if err != nil {
+				fmt.Printf("prune cache %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().StringVar(&cacheConfig.MaxSize, "max-size", "", "Keep the cache under this size, e.g. 20GB.")
+	cmd.Flags().DurationVar(&cacheConfig.MaxAge, "max-age", 0, "Remove the blobs not used for longer than this, e.g. 720h.")
+	cmd.Flags().BoolVar(&cacheConfig.DryRun, "dry-run", false, "If true, only print the blobs that would be removed.")
+	return cmd
+}
+
+func openCache() *cache.Cache {
+	c, err := cache.New(cacheConfig.Dir)
+	if err != nil {
+		fmt.Printf("open cache %v\n", err)
+		os.Exit(1)
+	}
+	return c
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/images"
+	"github.com/shipengqi/lighting-i/pkg/log"
+)
+
+// _latestPattern selects the 'latest' tag of the repositories if no tag filter
+// is set.
+var _latestPattern = &images.Pattern{Regex: "^latest$"}
+
+// catalogImageSet returns the image set of the repositories of the registry
+// catalog, filtered by '--org' and '--repo-regex'. The tags of every repository
+// are selected by '--tag-regex', '--tag-semver' and '--tag-latest', or the
+// 'latest' tag if none of them is set. The repositories without a matched tag,
+// or whose tags cannot be listed, are skipped with a warning.
+func catalogImageSet(ctx context.Context) (*images.ImageSet, error) {
+	var repoRegexp *regexp.Regexp
+	if downloadConfig.RepoRegex != "" {
+		re, err := regexp.Compile(downloadConfig.RepoRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --repo-regex: %v", err)
+		}
+		repoRegexp = re
+	}
+	var pattern *images.Pattern
+	if downloadConfig.TagRegex != "" || downloadConfig.TagSemver != "" || downloadConfig.TagLatest > 0 {
+		pattern = &images.Pattern{Regex: downloadConfig.TagRegex, Semver: downloadConfig.TagSemver, Latest: downloadConfig.TagLatest}
+		if pattern.Regex == "" && pattern.Semver == "" {
+			pattern.Regex = ".*"
+		}
+		if err := pattern.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	catalog, status := c.ListRepositories(ctx)
+	if status.Code != client.OK.Code {
+		return nil, &client.Errno{Code: status.Code, Message: fmt.Sprintf("list repositories: %s", status.Message)}
+	}
+	org := strings.Trim(downloadConfig.Org, "/")
+	imageSet := &images.ImageSet{OrgName: org}
+	// the repositories are on the registry of the catalog, the paths of the
+	// catalog are used as-is, e.g. 'nginx' is not 'library/nginx'
+	host := registryHost(Conf.Registry)
+	var lastErr error
+	for _, repo := range catalog.Repositories {
+		if org != "" && !strings.HasPrefix(repo, org+"/") {
+			continue
+		}
+		if repoRegexp != nil && !repoRegexp.MatchString(repo) {
+			continue
+		}
+		e := images.Entry{Image: repo, Registry: host, Pattern: pattern}
+		if pattern == nil {
+			e.Pattern = _latestPattern
+		}
+		tags, err := listPatternTags(ctx, e)
+		if err != nil {
+			log.Warnf("%v, skipped.", err)
+			lastErr = err
+			continue
+		}
+		if len(tags) == 0 && pattern == nil {
+			log.Warnf("%s has no 'latest' tag, skipped.", repo)
+			continue
+		}
+		if len(tags) == 0 {
+			log.Warnf("No tag of %s matched %s, skipped.", repo, pattern)
+			continue
+		}
+		e.Pattern = pattern
+		for _, t := range tags {
+			imageSet.Entries = append(imageSet.Entries, e.WithTag(t))
+		}
+	}
+	if len(imageSet.Entries) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	if len(imageSet.Entries) == 0 {
+		return nil, fmt.Errorf("no repository of the %d in the catalog matched", len(catalog.Repositories))
+	}
+	log.Infof("Found %d image(s) in the catalog.", len(imageSet.Entries))
+	return imageSet, nil
+}
+
+// registryHost returns the host of the registry URL.
+func registryHost(registry string) string {
+	u, err := url.Parse(registry)
+	if err != nil || u.Host == "" {
+		return strings.TrimSuffix(registry, "/")
+	}
+	return u.Host
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+)
+
+func TestCatalogImageSet(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	r.AddImage("nginx", "latest", []byte("nginx layer"))
+	r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("apiserver layer"))
+	r.AddImage("shipengqi/broken", "latest", []byte("broken layer"))
+	r.AddFault(registrytest.Fault{Method: http.MethodGet, Path: "/shipengqi/broken/tags/list", Status: http.StatusInternalServerError})
+	dir := setupDownload(t, r)
+	defer os.RemoveAll(dir)
+	downloadConfig.Org, downloadConfig.RepoRegex = "", ""
+	downloadConfig.TagRegex, downloadConfig.TagSemver, downloadConfig.TagLatest = "", "", 0
+
+	imageSet, err := catalogImageSet(context.Background())
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	if len(imageSet.Entries) != 1 {
+		t.Fatalf("Wanted 1 image, got %v", imageSet.Entries)
+	}
+	ref, err := imageSet.Entries[0].Reference()
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	if ref.Path != "nginx" || ref.Tag != "latest" {
+		t.Fatalf("Wanted nginx:latest, got %s", ref)
+	}
+	mcr := checkFetchManifestResult(fetchAllManifest(context.Background(), imageSet))
+	if len(mcr.Failed) > 0 {
+		t.Fatalf("Wanted no failed manifest, got %s", mcr.Failed[0].Status.Message)
+	}
+}
@@ -1,20 +1,30 @@
 package cmd
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/gosuri/uiprogress"
-	"github.com/gosuri/uiprogress/util/strutil"
 	"github.com/spf13/cobra"
 
 	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/filelock"
+	"github.com/shipengqi/lighting-i/pkg/images"
 	"github.com/shipengqi/lighting-i/pkg/log"
+	"github.com/shipengqi/lighting-i/pkg/progress"
+	"github.com/shipengqi/lighting-i/pkg/utils"
 )
 
 var (
@@ -23,16 +33,29 @@ var (
 	_defaultDownloadAlias    = "down"
 	_defaultUploadCommand    = "upload"
 	_defaultUploadAlias      = "up"
+	_defaultCacheCommand     = "cache"
+	_defaultGCCommand        = "gc"
+	_defaultLockCommand      = "lock"
+	_defaultLintCommand      = "lint"
+	_defaultImagesCommand    = "images"
+	_defaultSyncCommand      = "sync"
+	_defaultServeCommand     = "serve"
 	_defaultBaseDir          = "/var/opt/lighting"
 	_defaultImageSet         = _defaultBaseDir + "/image_set.yaml"
 	_defaultImagesDir        = _defaultBaseDir + "/offline"
-	_defaultDownloadLockFile = _defaultBaseDir + "/images.download.lock"
-	_defaultUploadLockFile   = _defaultBaseDir + "/images.upload.lock"
+	_defaultCacheDir         = _defaultBaseDir + "/cache"
+	_defaultDownloadLock     = "images.download.lock"
+	_defaultUploadLock       = "images.upload.lock"
 	_defaultManifestJson     = "manifest.json"
 	_defaultDownloadManifest = "images.download.manifest"
 	_defaultUploadManifest   = "images.upload.manifest"
+	_defaultDownloadBase     = "images.download.base"
 	_defaultDownloadLog      = "images.download.log"
 	_defaultUploadLog        = "images.upload.log"
+	_defaultLockLog          = "images.lock.log"
+	_defaultSyncLog          = "images.sync.log"
+	_defaultServeLog         = "images.serve.log"
+	_defaultChaosEnv         = "LIGHTING_CHAOS"
 )
 
 var Conf Config
@@ -45,6 +68,10 @@ type Config struct {
 	Password    string
 	RetryTimes  int
 	Registry    string
+	// Auths are the credentials of the other registries, in the form of <host>=<username>:<password>
+	Auths       []string
+	// Chaos is the spec of the faults injected into the requests, see client.ParseChaos
+	Chaos       string
 }
 
 func NewLightingCommand() *cobra.Command {
@@ -52,6 +79,16 @@ func NewLightingCommand() *cobra.Command {
 		Use:   _defaultRootCommand,
 		Short: "lighting is used to bulk download or upload docker images. It's much faster than 'docker pull'",
 		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			if Conf.Chaos != "" {
+				if _, err := client.ParseChaos(Conf.Chaos); err != nil {
+					fmt.Printf("chaos %v\n", err)
+					os.Exit(_exitInvalidInput)
+				}
+			}
+			// sub commands may accept arguments
+			if cmd.HasParent() {
+				return
+			}
 			if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
 				_ = cmd.Help()
 				os.Exit(0)
@@ -64,58 +101,329 @@ func NewLightingCommand() *cobra.Command {
 
 	// Reset Flags
 	lightingCmd.ResetFlags()
+	lightingCmd.PersistentFlags().StringVar(&Conf.Chaos, "chaos", os.Getenv(_defaultChaosEnv),
+		"Inject faults into the registry requests to rehearse a bad network, e.g. latency=200ms,drop=0.05,5xx=0.1,429=0.05,seed=1.")
+	_ = lightingCmd.PersistentFlags().MarkHidden("chaos")
 
 	// Disable commands sorting
 	cobra.EnableCommandSorting = false
 	// Add sub commands
 	lightingCmd.AddCommand(downloadCommand())
 	lightingCmd.AddCommand(uploadCommand())
+	lightingCmd.AddCommand(syncCommand())
+	lightingCmd.AddCommand(serveCommand())
+	lightingCmd.AddCommand(lockCommand())
+	lightingCmd.AddCommand(lintCommand())
+	lightingCmd.AddCommand(imagesCommand())
+	lightingCmd.AddCommand(cacheCommand())
+	lightingCmd.AddCommand(gcCommand())
 
 	return lightingCmd
 }
 
-func handleSignals(exitCh chan int) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+// The exit codes of download, upload, sync and lock.
+const (
+	_exitSuccess      = 0
+	_exitFailure      = 1   // an unexpected error, e.g. the download directory cannot be written
+	_exitPartial      = 2   // some of the images failed
+	_exitInvalidInput = 3   // invalid flags, images set file, lock file or download directory
+	_exitAuth         = 4   // the registry rejected the credential
+	_exitUnreachable  = 5   // the registry cannot be reached
+	_exitLockHeld     = 6   // another instance holds the lock
+	_exitInterrupted  = 130 // interrupted by SIGINT, SIGTERM or SIGQUIT
+)
 
-	for {
-		s := <-c
-		switch s {
-		case syscall.SIGINT: // kill -SIGINT XXXX or Ctrl+c
-			log.Warn("[SIGNAL] Catch SIGINT")
-			exitCh <- 0
+// The scopes of the process lock of download and upload.
+const (
+	_lockScopeGlobal = "global" // one instance on the host
+	_lockScopeDir    = "dir"    // one instance per '--dir'
+)
+
+// processLockFile returns the path of the process lock file name of the
+// scope, dir is the '--dir' of the command.
+func processLockFile(scope, name, dir string) (string, error) {
+	switch scope {
+	case _lockScopeGlobal:
+		return filepath.Join(_defaultBaseDir, name), nil
+	case _lockScopeDir:
+		return filepath.Join(dir, name), nil
+	}
+	return "", fmt.Errorf("invalid --lock-scope %q, want global or dir", scope)
+}
 
-		case syscall.SIGTERM: // kill -SIGTERM XXXX
-			log.Warn("[SIGNAL] Catch SIGTERM")
-			exitCh <- 1
+// forceRemoved is the error of the removed '--force' flag.
+const forceRemoved = "'--force' is removed, the process lock cannot be ignored. Use '--lock-scope dir' to allow one instance per directory."
 
-		case syscall.SIGQUIT: // kill -SIGQUIT XXXX
-			log.Warn("[SIGNAL] Catch SIGQUIT")
-			exitCh <- 0
-		default:
-			return
+// acquireLock acquires the process lock of the file name, it waits up to wait
+// if another instance holds it. The lock left by a crashed instance is
+// recovered.
+func acquireLock(name string, wait time.Duration) error {
+	if owner, ok := filelock.Stale(name); ok {
+		log.Warnf("Recover the stale lock %s of %s.", name, owner)
+	}
+	err := filelock.Lock(name)
+	if _, ok := err.(*filelock.LockedError); ok && wait > 0 {
+		log.Infof("%v, waiting up to %s ...", err, wait)
+		err = filelock.LockWait(name, wait)
+	}
+	return err
+}
+
+// lockExitCode returns _exitLockHeld if the lock is held by another instance,
+// _exitFailure otherwise, e.g. the lock file cannot be created.
+func lockExitCode(err error) int {
+	if _, ok := err.(*filelock.LockedError); ok {
+		return _exitLockHeld
+	}
+	return _exitFailure
+}
+
+// isAuthStatus reports whether the registry rejected the credential.
+func isAuthStatus(status *client.Errno) bool {
+	return status.Code == client.UnauthorizedErr.Code || status.Code == client.ForbiddenErr.Code
+}
+
+// statusExitCode returns _exitAuth if one of the statuses is rejected by the
+// registry, code otherwise.
+func statusExitCode(code int, statuses ...*client.Errno) int {
+	for _, s := range statuses {
+		if s != nil && isAuthStatus(s) {
+			return _exitAuth
 		}
 	}
+	return code
+}
+
+// errorExitCode returns the exit code of an error: the errors of the requests
+// are *client.Errno, they are _exitAuth or _exitFailure. A request which cannot
+// be sent is a *url.Error, the registry is unreachable. The other errors are
+// caused by the input.
+func errorExitCode(err error) int {
+	if status, ok := err.(*client.Errno); ok {
+		return statusExitCode(_exitFailure, status)
+	}
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return _exitUnreachable
+	}
+	return _exitInvalidInput
 }
 
-func initClient() error {
-	c = client.New()
-	c.SetHostURL(Conf.Registry)
-	c.SetSecureSkip(true)
-	c.SetUsername(Conf.User)
-	c.SetPassword(Conf.Password)
-	c.SetRetryCount(Conf.RetryTimes)
-	c.SetRetryMaxWaitTime(time.Second * 5)
+// signalContext returns a context which is canceled on SIGINT, SIGTERM or
+// SIGQUIT, the in-flight requests are aborted. stop releases the signals.
+func signalContext() (ctx context.Context, stop context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		select {
+		case s := <-ch:
+			log.Warnf("[SIGNAL] Catch %s, canceling ...", signalName(s))
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(ch)
+		cancel()
+	}
+}
 
-	log.Infof("Ping %s ...", c.HostURL)
-	if err := c.Ping(); err != nil {
-		log.Errorf("ping registry %v.", err)
+// exitWith runs the command with the context of signalContext and exits with
+// the code returned by run, or _exitInterrupted if the context is canceled.
+// The deferred functions of run are done before the exit.
+func exitWith(run func(ctx context.Context) int) {
+	ctx, stop := signalContext()
+	code := run(ctx)
+	if ctx.Err() != nil {
+		code = _exitInterrupted
+	}
+	stop()
+	os.Exit(code)
+}
+
+func signalName(s os.Signal) string {
+	switch s {
+	case syscall.SIGINT: // kill -SIGINT XXXX or Ctrl+c
+		return "SIGINT"
+	case syscall.SIGTERM: // kill -SIGTERM XXXX
+		return "SIGTERM"
+	case syscall.SIGQUIT: // kill -SIGQUIT XXXX
+		return "SIGQUIT"
+	}
+	return s.String()
+}
+
+var (
+	clientsMu  sync.Mutex
+	clients    = make(map[string]*client.Client)
+	clientErrs = make(map[string]error)
+)
+
+func initClient(ctx context.Context) error {
+	cli, err := newClient(ctx, Conf.Registry, Conf.User, Conf.Password)
+	if err != nil {
 		return err
 	}
-	log.Infof("Ping %s OK", c.HostURL)
+	c = cli
 	return nil
 }
 
+func newClient(ctx context.Context, url, user, password string) (*client.Client, error) {
+	cli := client.New()
+	cli.SetHostURL(url)
+	cli.SetSecureSkip(true)
+	cli.SetUsername(user)
+	cli.SetPassword(password)
+	// resty counts the first attempt in the retry count
+	cli.SetRetryCount(Conf.RetryTimes + 1)
+	cli.SetRetryMaxWaitTime(time.Second * 5)
+	if Conf.Chaos != "" {
+		chaos, err := client.ParseChaos(Conf.Chaos)
+		if err != nil {
+			return nil, err
+		}
+		log.Warnf("Chaos mode is enabled for %s: %s.", url, chaos)
+		cli.SetChaos(chaos)
+	}
+
+	log.Infof("Ping %s ...", cli.HostURL)
+	if err := cli.Ping(ctx); err != nil {
+		log.Errorf("ping registry %v.", err)
+		return nil, err
+	}
+	log.Infof("Ping %s OK", cli.HostURL)
+	return cli, nil
+}
+
+// registryClient returns the client of the registry host, the default client
+// is returned for an empty host or the host of '--registry'. The clients of
+// the other registries are created once, with the credentials of '--auth'.
+func registryClient(ctx context.Context, host string) (*client.Client, error) {
+	url := images.RegistryURL(host)
+	if host == "" || host == registryHost(Conf.Registry) || url == strings.TrimSuffix(Conf.Registry, "/") {
+		return c, nil
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if cli, ok := clients[host]; ok {
+		return cli, nil
+	}
+	if err, ok := clientErrs[host]; ok {
+		return nil, err
+	}
+	user, password := registryCredential(host)
+	cli, err := newClient(ctx, url, user, password)
+	if err != nil {
+		clientErrs[host] = err
+		return nil, err
+	}
+	clients[host] = cli
+	return cli, nil
+}
+
+// resolveTagPatterns replaces the entries with tag patterns by the entries of
+// the matched tags of the images, the tags are listed from the registries. The
+// resolved tags which are already in the image set are skipped.
+func resolveTagPatterns(ctx context.Context, entries []images.Entry) ([]images.Entry, error) {
+	var resolved []images.Entry
+	seen := make(map[string]bool)
+	var errs []string
+	var statuses []*client.Errno
+	for _, e := range entries {
+		if e.Pattern != nil {
+			continue
+		}
+		if ref, err := e.Reference(); err == nil {
+			seen[ref.String()] = true
+		}
+		resolved = append(resolved, e)
+	}
+	for _, e := range entries {
+		if e.Pattern == nil {
+			continue
+		}
+		tags, err := listPatternTags(ctx, e)
+		if err != nil {
+			if status, ok := err.(*client.Errno); ok {
+				statuses = append(statuses, status)
+			}
+			errs = append(errs, err.Error())
+			continue
+		}
+		if len(tags) == 0 {
+			errs = append(errs, fmt.Sprintf("%s: no tag matched", e))
+			continue
+		}
+		log.Infof("Resolved %s to %d tag(s): %s.", e, len(tags), strings.Join(tags, ", "))
+		for _, t := range tags {
+			te := e.WithTag(t)
+			ref, err := te.Reference()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", te, err))
+				continue
+			}
+			if seen[ref.String()] {
+				continue
+			}
+			seen[ref.String()] = true
+			resolved = append(resolved, te)
+		}
+	}
+	if len(errs) > 0 {
+		message := fmt.Sprintf("\n  %s", strings.Join(errs, "\n  "))
+		// the tags cannot be listed, the error is an Errno to tell it apart
+		// from an invalid pattern
+		for _, status := range statuses {
+			if isAuthStatus(status) {
+				return nil, &client.Errno{Code: status.Code, Message: message}
+			}
+		}
+		if len(statuses) > 0 {
+			return nil, &client.Errno{Code: statuses[0].Code, Message: message}
+		}
+		return nil, fmt.Errorf("%s", message)
+	}
+	return resolved, nil
+}
+
+// listPatternTags returns the tags of the image of the entry matched by the
+// pattern of the entry, the newest first.
+func listPatternTags(ctx context.Context, e images.Entry) ([]string, error) {
+	ref, err := e.Reference()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", e, err)
+	}
+	cli, err := registryClient(ctx, ref.Domain)
+	if err != nil {
+		return nil, &client.Errno{Code: client.InternalServerErr.Code, Message: fmt.Sprintf("%s: %v", e, err)}
+	}
+	tags, status := cli.ListImageTags(ctx, ref.Path)
+	if status.Code != client.OK.Code {
+		return nil, &client.Errno{Code: status.Code, Message: fmt.Sprintf("list tags of %s: %s", ref.Name(), status.Message)}
+	}
+	matched, err := e.Pattern.Match(tags.Tags)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", e, err)
+	}
+	return matched, nil
+}
+
+func registryCredential(host string) (string, string) {
+	for _, a := range Conf.Auths {
+		s := strings.SplitN(a, "=", 2)
+		if len(s) != 2 || s[0] != host {
+			continue
+		}
+		cred := strings.SplitN(s[1], ":", 2)
+		if len(cred) != 2 {
+			return cred[0], ""
+		}
+		return cred[0], cred[1]
+	}
+	return "", ""
+}
+
 func initDir(dirPath string) (string, error) {
 	folderPath := filepath.Join(dirPath, time.Now().Format("20060102150405"))
 	if err := os.MkdirAll(folderPath, 777); err != nil {
@@ -124,13 +432,81 @@ func initDir(dirPath string) (string, error) {
 	return folderPath, nil
 }
 
-func addProgressBar(total int, image client.ImageRepo) *uiprogress.Bar {
-	title := fmt.Sprintf("%s:%s", strings.Split(image.Name, "/")[1], image.Tag)
-	bar := uiprogress.AddBar(total).AppendCompleted().AppendElapsed()
-	bar.Width = _defaultProgressWidth
-	// prepend the deploy step to the bar
-	bar.PrependFunc(func(b *uiprogress.Bar) string {
-		return strutil.Resize(title, uint(_defaultProgressTitleWidth))
-	})
-	return bar
-}
\ No newline at end of file
+// resolveBlobTarget returns the path of a downloaded blob, or "" if it cannot be
+// found. A bundle may have been moved since it was downloaded, and a delta bundle
+// refers to the blobs of its base, so the recorded target is looked up in the
+// bundle directory and then along the chain of base bundles.
+func resolveBlobTarget(dir, target string) string {
+	if utils.PathIsExist(target) {
+		return target
+	}
+	visited := make(map[string]bool)
+	for dir != "" && !visited[dir] {
+		visited[dir] = true
+		p := filepath.Join(dir, filepath.Base(target))
+		if utils.PathIsExist(p) {
+			return p
+		}
+		base, err := ioutil.ReadFile(filepath.Join(dir, _defaultDownloadBase))
+		if err != nil {
+			return ""
+		}
+		dir = strings.TrimSpace(string(base))
+	}
+	return ""
+}
+
+// TransferStats counts the bytes of the blobs, it is safe for concurrent use.
+type TransferStats struct {
+	// Transferred is the bytes transferred from or to the registry
+	Transferred int64
+	// Deduplicated is the bytes of the blobs shared by images, which are transferred once
+	Deduplicated int64
+	// Skipped is the bytes of the blobs which are not transferred, because they exist already
+	Skipped int64
+}
+
+func (s *TransferStats) AddTransferred(n int64) {
+	atomic.AddInt64(&s.Transferred, n)
+}
+
+func (s *TransferStats) AddDeduplicated(n int64) {
+	atomic.AddInt64(&s.Deduplicated, n)
+}
+
+func (s *TransferStats) AddSkipped(n int64) {
+	atomic.AddInt64(&s.Skipped, n)
+}
+
+// manifestMediaType returns the media type of the manifest content, the
+// default is the Docker image manifest v2 schema 2.
+func manifestMediaType(content []byte) string {
+	mt := &struct {
+		MediaType string `json:"mediaType"`
+	}{}
+	if err := json.Unmarshal(content, mt); err != nil || mt.MediaType == "" {
+		return client.MediaTypeManifest
+	}
+	return mt.MediaType
+}
+
+// initProgress sets the progress output mode. The JSON progress is the only
+// output on stdout, so the messages are printed to stderr.
+func initProgress(mode string) error {
+	if err := progress.SetMode(mode); err != nil {
+		return err
+	}
+	if progress.Mode() == progress.ModeJSON {
+		log.SetConsole(os.Stderr)
+	}
+	return nil
+}
+
+func addProgressBar(total int64, image client.ImageRepo) *progress.Bar {
+	title := fmt.Sprintf("%s:%s", path.Base(image.Name), image.Tag)
+	return progress.AddBar(title, total)
+}
+
+func addTotalProgressBar(total int64) *progress.Bar {
+	return progress.AddBar("Total", total)
+}
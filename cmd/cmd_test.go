@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+	"github.com/shipengqi/lighting-i/pkg/images"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		title    string
+		err      error
+		expected int
+	}{
+		{"Unauthorized", &client.Errno{Code: http.StatusUnauthorized}, _exitAuth},
+		{"Forbidden", &client.Errno{Code: http.StatusForbidden}, _exitAuth},
+		{"Server error", &client.Errno{Code: http.StatusInternalServerError}, _exitFailure},
+		{"Invalid input", errors.New("invalid pattern"), _exitInvalidInput},
+		{"Unreachable", &url.Error{Op: "Get", URL: "https://127.0.0.1:1/v2/", Err: errors.New("connection refused")}, _exitUnreachable},
+	}
+	for _, v := range tests {
+		t.Run(v.title, func(t *testing.T) {
+			if code := errorExitCode(v.err); code != v.expected {
+				t.Fatalf("Wanted %d, got %d", v.expected, code)
+			}
+		})
+	}
+
+	t.Run("Partial failure", func(t *testing.T) {
+		if code := statusExitCode(_exitPartial, client.NotFoundErr, client.InternalServerErr); code != _exitPartial {
+			t.Fatalf("Wanted %d, got %d", _exitPartial, code)
+		}
+	})
+}
+
+func TestInitClientExitCode(t *testing.T) {
+	defer func() { Conf.Chaos = "" }()
+
+	t.Run("Unreachable registry", func(t *testing.T) {
+		r := registrytest.New()
+		r.Close()
+		Conf.Registry, Conf.User, Conf.Password = r.URL, "", ""
+		err := initClient(context.Background())
+		if code := errorExitCode(err); code != _exitUnreachable {
+			t.Fatalf("Wanted %d, got %d: %v", _exitUnreachable, code, err)
+		}
+	})
+
+	t.Run("Invalid chaos option", func(t *testing.T) {
+		Conf.Chaos = "unknown=1"
+		err := initClient(context.Background())
+		if code := errorExitCode(err); code != _exitInvalidInput {
+			t.Fatalf("Wanted %d, got %d: %v", _exitInvalidInput, code, err)
+		}
+	})
+}
+
+func TestAuthExitCode(t *testing.T) {
+	r := registrytest.New(registrytest.WithBasicAuth("admin", "secret"))
+	defer r.Close()
+	r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("layer"))
+	Conf.Registry, Conf.User, Conf.Password = r.URL, "admin", "wrong"
+	if err := initClient(context.Background()); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	lockedDigests = nil
+
+	t.Run("Fetch manifests", func(t *testing.T) {
+		imageSet := &images.ImageSet{Entries: []images.Entry{{Image: "shipengqi/apiserver:v1.0.0"}}}
+		mcr := checkFetchManifestResult(fetchAllManifest(context.Background(), imageSet))
+		var statuses []*client.Errno
+		for _, m := range mcr.Failed {
+			statuses = append(statuses, m.Status)
+		}
+		if code := statusExitCode(_exitFailure, statuses...); code != _exitAuth {
+			t.Fatalf("Wanted %d, got %d", _exitAuth, code)
+		}
+	})
+
+	t.Run("Resolve tag patterns", func(t *testing.T) {
+		entries := []images.Entry{{Image: "shipengqi/apiserver", Pattern: &images.Pattern{Regex: ".*"}}}
+		_, err := resolveTagPatterns(context.Background(), entries)
+		if code := errorExitCode(err); code != _exitAuth {
+			t.Fatalf("Wanted %d, got %d: %v", _exitAuth, code, err)
+		}
+	})
+}
+
+func TestProcessLockFile(t *testing.T) {
+	tests := []struct {
+		title    string
+		scope    string
+		expected string
+	}{
+		{"Global", _lockScopeGlobal, filepath.Join(_defaultBaseDir, _defaultDownloadLock)},
+		{"Dir", _lockScopeDir, filepath.Join("/data/a", _defaultDownloadLock)},
+	}
+	for _, v := range tests {
+		t.Run(v.title, func(t *testing.T) {
+			file, err := processLockFile(v.scope, _defaultDownloadLock, "/data/a")
+			if err != nil || file != v.expected {
+				t.Fatalf("Wanted %s, got %s, %v", v.expected, file, err)
+			}
+		})
+	}
+
+	for _, scope := range []string{"host", "", _lockScopeImageSet} {
+		t.Run("Invalid scope "+scope, func(t *testing.T) {
+			if _, err := processLockFile(scope, _defaultUploadLock, "/data/a"); err == nil {
+				t.Fatal("Wanted error, got nil")
+			}
+		})
+	}
+
+	t.Run("Image set", func(t *testing.T) {
+		downloadConfig.LockScope, downloadConfig.Catalog = _lockScopeImageSet, false
+		defer func() { downloadConfig.LockScope = _lockScopeGlobal }()
+		downloadConfig.ImagesSet = "/opt/a/image_set.yaml"
+		a, err := downloadProcessLockFile()
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		downloadConfig.ImagesSet = "/opt/b/image_set.yaml"
+		b, _ := downloadProcessLockFile()
+		if a == b || filepath.Dir(a) != _defaultBaseDir || filepath.Ext(a) != ".lock" {
+			t.Fatalf("Wanted different lock files under %s, got %s and %s", _defaultBaseDir, a, b)
+		}
+	})
+}
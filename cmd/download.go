@@ -1,40 +1,54 @@
 package cmd
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"math"
 	"os"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gosuri/uiprogress"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
+	"github.com/shipengqi/lighting-i/pkg/cache"
 	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
 	"github.com/shipengqi/lighting-i/pkg/filelock"
 	"github.com/shipengqi/lighting-i/pkg/images"
 	"github.com/shipengqi/lighting-i/pkg/log"
+	"github.com/shipengqi/lighting-i/pkg/progress"
 	"github.com/shipengqi/lighting-i/pkg/utils"
 )
 
-var (
-	_defaultProgressWidth      = 50
-	_defaultProgressTitleWidth = 30
-)
-
 type DownloadConfig struct {
 	Dir         string
 	User        string
 	Password    string
+	Auths       []string
 	RetryTimes  int
 	Registry    string
 	Force       bool
+	LockScope   string
+	Wait        time.Duration
+	Progress    string
 	ImagesSet   string
+	Strict      bool
+	Since       string
+	CacheDir    string
+	NoCache     bool
+	IgnoreSpace bool
+	Locked      bool
+	LockFile    string
+	Catalog     bool
+	Org         string
+	RepoRegex   string
+	TagRegex    string
+	TagSemver   string
+	TagLatest   int
 }
 
 type ManifestResponse struct {
@@ -45,7 +59,7 @@ type ManifestResponse struct {
 type ManifestCheckResult struct {
 	Required  *sync.Map
 	Failed    []ManifestResponse
-	TotalSize int
+	TotalSize int64
 }
 
 type LayerResponse struct {
@@ -54,28 +68,66 @@ type LayerResponse struct {
 	Target string
 }
 
+// RequiredLayer is a blob required by one or more images, it is fetched once.
 type RequiredLayer struct {
-	Fetched bool
-	Layer   client.Layer
-	Image   client.ImageRepo
+	Layer  client.Layer
+	Image  client.ImageRepo
+	once   sync.Once
+	target string
+	status *client.Errno
 }
 
 type DownloadManifest struct {
-	Config LayerResponse
-	Layers []LayerResponse
-	Image  client.ImageRepo
+	// Manifest is the manifest content of the image, it is pushed as is by 'upload'
+	Manifest LayerResponse
+	Config   LayerResponse
+	Layers   []LayerResponse
+	Image    client.ImageRepo
 }
 
 var downloadConfig DownloadConfig
+var downloadStats TransferStats
+
+// baseBlobs holds the blobs of the bundle given by '--since', keyed by digest.
+var baseBlobs map[string]string
+
+// blobCache is the shared blob cache, it is nil if '--no-cache' is set.
+var blobCache *cache.Cache
+
+// downloadLockFile is the process lock file of the scope of '--lock-scope'.
+var downloadLockFile string
+
+// lockedDigests holds the digests of the lock file keyed by the references, it
+// is nil if '--locked' is not set.
+var lockedDigests map[string]string
 
 func addDownloadFlags(flagSet *pflag.FlagSet) {
 	flagSet.StringVarP(&downloadConfig.Registry, "registry", "r", "https://registry-1.docker.io", "The host of the registry.")
 	flagSet.StringVarP(&downloadConfig.ImagesSet, "image-set", "i", _defaultImageSet, "Images set file path.")
+	flagSet.BoolVar(&downloadConfig.Strict, "strict", false, "If true, fail on the warnings of the image set too, e.g. the duplicate images.")
 	flagSet.StringVarP(&downloadConfig.User, "user", "u", "", "Registry account username.")
 	flagSet.StringVarP(&downloadConfig.Password, "pass", "p", "", "Registry account password.")
+	flagSet.StringArrayVar(&downloadConfig.Auths, "auth", nil, "Credential of another registry in the image set, in the form of <host>=<username>:<password>, can be repeated.")
 	flagSet.IntVarP(&downloadConfig.RetryTimes, "retry", "t", 0, "The retry times when the image download fails.")
 	flagSet.StringVarP(&downloadConfig.Dir, "dir", "d", _defaultImagesDir,"Images tar directory path.")
-	flagSet.BoolVarP(&downloadConfig.Force, "force", "f", false, "If true, ignore the process lock.")
+	flagSet.StringVar(&downloadConfig.LockScope, "lock-scope", _lockScopeGlobal,
+		"Scope of the process lock: global (one download on the host), dir (one download per --dir) or image-set (one download per image set).")
+	flagSet.BoolVarP(&downloadConfig.Force, "force", "f", false, "Removed, use --lock-scope instead.")
+	_ = flagSet.MarkHidden("force")
+	flagSet.DurationVar(&downloadConfig.Wait, "wait", 0, "Wait up to this duration for the running instance to release the process lock, e.g. 10m. Default is to fail at once.")
+	flagSet.StringVar(&downloadConfig.Progress, "progress", progress.ModeAuto, "Progress output: auto, bar, plain, json or none. 'auto' prints plain lines if stdout is not a terminal.")
+	flagSet.StringVarP(&downloadConfig.Since, "since", "s", "", "Previous download directory or manifest, only the blobs missing from it are downloaded.")
+	flagSet.StringVar(&downloadConfig.CacheDir, "cache-dir", _defaultCacheDir, "Shared blob cache directory path.")
+	flagSet.BoolVar(&downloadConfig.NoCache, "no-cache", false, "If true, do not use the shared blob cache.")
+	flagSet.BoolVar(&downloadConfig.IgnoreSpace, "ignore-space-check", false, "If true, download even if the disk space is not enough.")
+	flagSet.BoolVar(&downloadConfig.Locked, "locked", false, "If true, download the digests of the lock file, fail if the image set or the tags drift from it.")
+	flagSet.StringVar(&downloadConfig.LockFile, "lock-file", "", "Lock file path, default is <image-set>.lock.yaml.")
+	flagSet.BoolVar(&downloadConfig.Catalog, "catalog", false, "If true, download the repositories of the registry catalog instead of the image set.")
+	flagSet.StringVar(&downloadConfig.Org, "org", "", "Only download the repositories of the namespace, used with --catalog.")
+	flagSet.StringVar(&downloadConfig.RepoRegex, "repo-regex", "", "Only download the repositories matching the regex, used with --catalog.")
+	flagSet.StringVar(&downloadConfig.TagRegex, "tag-regex", "", "Download the tags matching the regex, used with --catalog. Default is the 'latest' tag.")
+	flagSet.StringVar(&downloadConfig.TagSemver, "tag-semver", "", "Download the tags matching the semver constraint, used with --catalog.")
+	flagSet.IntVar(&downloadConfig.TagLatest, "tag-latest", 0, "Download the newest N matched tags of every repository, used with --catalog.")
 }
 
 func downloadCommand() *cobra.Command {
@@ -89,11 +141,25 @@ func downloadCommand() *cobra.Command {
 			Conf.Registry = downloadConfig.Registry
 			Conf.User = downloadConfig.User
 			Conf.Password = downloadConfig.Password
+			Conf.Auths = downloadConfig.Auths
+			if err := initProgress(downloadConfig.Progress); err != nil {
+				fmt.Println(err)
+				os.Exit(_exitInvalidInput)
+			}
+			if downloadConfig.Force {
+				fmt.Println(forceRemoved)
+				os.Exit(_exitInvalidInput)
+			}
+			lockFile, err := downloadProcessLockFile()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(_exitInvalidInput)
+			}
 			// Create required dir and create download directory by date
 			folderPath, err := initDir(downloadConfig.Dir)
 			if err != nil {
 				fmt.Printf("mkdir %v", err)
-				os.Exit(1)
+				os.Exit(_exitFailure)
 			}
 			ImageDateFolderPath = folderPath
 
@@ -104,82 +170,23 @@ func downloadCommand() *cobra.Command {
 			log.Debugf("Init log file: %s", LogFilePath)
 			log.Debugf("Using image set file: %s", downloadConfig.ImagesSet)
 
-			if downloadConfig.Force {
-				return
+			log.Debugf("Using process lock: %s", lockFile)
+			if err := acquireLock(lockFile, downloadConfig.Wait); err != nil {
+				log.Errorf("lock %v.", err)
+				log.Errorf("Only one instance is allowed at a time in the %s scope, use '--wait' to wait for the running instance.", downloadConfig.LockScope)
+				os.Exit(lockExitCode(err))
 			}
+			downloadLockFile = lockFile
 
-			if err := filelock.Lock(_defaultDownloadLockFile); err != nil {
-				log.Error("One instance is already running and only one instance is allowed at a time.")
-				log.Error("Check to see if another instance is running.")
-				log.Fatalf("If the instance stops running, delete %s file.\n", _defaultDownloadLockFile)
+			// Lock the download directory, so that it is not deleted by 'gc' while downloading
+			if err := acquireLock(filepath.Join(ImageDateFolderPath, _defaultDownloadLock), downloadConfig.Wait); err != nil {
+				_ = filelock.UnLock(downloadLockFile)
+				log.Errorf("lock %v.", err)
+				os.Exit(lockExitCode(err))
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			defer func() {
-				log.Infof("You can refer to %s for more detail.", LogFilePath)
-				filelock.UnLock(_defaultDownloadLockFile)
-			}()
-			if !checkImageSet(downloadConfig.ImagesSet) {
-				log.Errorf("%s is not exists.", downloadConfig.ImagesSet)
-				return
-			}
-			err := initClient()
-			if err != nil {
-				log.Errorf("init client %v.", err)
-				return
-			}
-
-			imageSet, err := images.GetImagesFromSet(downloadConfig.ImagesSet)
-			if err != nil {
-				log.Errorf("get images %v.", err)
-				return
-			}
-			log.Debug("read image set", imageSet)
-			if imageSet.OrgName == "" {
-				imageSet.OrgName = "official library"
-			}
-			log.Infof("Starting the download of the %s ...", imageSet.OrgName)
-
-			allManifest := fetchAllManifest(imageSet)
-			log.Debug("fetch manifest", allManifest)
-			mcr := checkFetchManifestResult(allManifest)
-			if len(mcr.Failed) > 0 {
-				log.Errorf("Fetch images manifest with errors.")
-				return
-			}
-			err = generateManifestFile(allManifest)
-			if err != nil {
-				log.Errorf("manifest file %v.", err)
-				return
-			}
-
-			log.Info("Warning: Please make sure you have enough disk space for downloading images.")
-			log.Infof("Total size of the images: %d MB.", mcr.TotalSize)
-
-			completedc := make(chan int, 1)
-			go downloadImages(allManifest, mcr.Required, completedc)
-
-			exitc := make(chan int, 1)
-			go handleSignals(exitc)
-			for {
-				select {
-				case failc := <-completedc:
-					if failc < 1 {
-						log.Infof("Successfully downloaded the images to %s.", ImageDateFolderPath)
-					} else {
-						log.Errorf("Download images with %d error(s).", failc)
-					}
-
-					log.Infof("You can refer to %s for more detail.", LogFilePath)
-					filelock.UnLock(_defaultDownloadLockFile)
-					os.Exit(0)
-				case code := <-exitc:
-					filelock.UnLock(_defaultDownloadLockFile)
-					os.Exit(code)
-				default:
-					time.Sleep(10 * time.Millisecond)
-				}
-			}
+			exitWith(runDownload)
 		},
 	}
 	cmd.Flags().SortFlags = false
@@ -187,6 +194,168 @@ func downloadCommand() *cobra.Command {
 	return cmd
 }
 
+// runDownload downloads the images, it returns the exit code. If ctx is
+// canceled, the in-flight downloads are aborted and the partial blobs are
+// removed, the blobs downloaded already are recorded in the download manifest.
+func runDownload(ctx context.Context) int {
+	defer func() {
+		log.Infof("You can refer to %s for more detail.", LogFilePath)
+		unlockDownload()
+	}()
+	if downloadConfig.Catalog && downloadConfig.Locked {
+		log.Errorf("--locked cannot be used with --catalog.")
+		return _exitInvalidInput
+	}
+	if !downloadConfig.Catalog && !checkImageSet(downloadConfig.ImagesSet) {
+		log.Errorf("%s is not exists.", downloadConfig.ImagesSet)
+		return _exitInvalidInput
+	}
+	err := initClient(ctx)
+	if err != nil {
+		log.Errorf("init client %v.", err)
+		return errorExitCode(err)
+	}
+
+	if !downloadConfig.NoCache {
+		blobCache, err = cache.New(downloadConfig.CacheDir)
+		if err != nil {
+			log.Errorf("init cache %v.", err)
+			return _exitFailure
+		}
+		log.Debugf("Using blob cache: %s", downloadConfig.CacheDir)
+	}
+
+	var imageSet *images.ImageSet
+	if downloadConfig.Catalog {
+		imageSet, err = catalogImageSet(ctx)
+		if err != nil {
+			log.Errorf("catalog %v.", err)
+			return errorExitCode(err)
+		}
+	} else {
+		imageSet, err = images.GetImagesFromSet(downloadConfig.ImagesSet)
+		if err != nil {
+			log.Errorf("get images %v.", err)
+			return _exitInvalidInput
+		}
+		log.Debug("read image set", imageSet)
+		if !checkImageSetWarnings(imageSet, downloadConfig.Strict) {
+			return _exitInvalidInput
+		}
+		imageSet.Entries, err = resolveTagPatterns(ctx, imageSet.Entries)
+		if err != nil {
+			log.Errorf("resolve tag patterns %v.", err)
+			return errorExitCode(err)
+		}
+	}
+	if downloadConfig.Locked {
+		lockFile := downloadConfig.LockFile
+		if lockFile == "" {
+			lockFile = images.LockFileName(downloadConfig.ImagesSet)
+		}
+		lockedDigests, err = checkLockFile(ctx, imageSet, lockFile)
+		if err != nil {
+			log.Errorf("lock file %v.", err)
+			return errorExitCode(err)
+		}
+		log.Infof("Using the digests of %s.", lockFile)
+	}
+	if downloadConfig.Since != "" {
+		baseDir, blobs, err := loadBaseBundle(downloadConfig.Since)
+		if err != nil {
+			log.Errorf("load base bundle %v.", err)
+			return _exitInvalidInput
+		}
+		if err = generateBaseFile(baseDir); err != nil {
+			log.Errorf("base file %v.", err)
+			return _exitFailure
+		}
+		baseBlobs = blobs
+		log.Infof("Using %s as the base, %d blob(s) will be skipped.", baseDir, len(baseBlobs))
+	}
+	org := imageSet.OrgName
+	if org == "" {
+		org = "official library"
+	}
+	log.Infof("Starting the download of the %s ...", org)
+
+	allManifest := fetchAllManifest(ctx, imageSet)
+	log.Debug("fetch manifest", allManifest)
+	if ctx.Err() != nil {
+		log.Warnf("The download is interrupted.")
+		return _exitInterrupted
+	}
+	mcr := checkFetchManifestResult(allManifest)
+	if len(mcr.Failed) > 0 {
+		var statuses []*client.Errno
+		for _, m := range mcr.Failed {
+			log.Errorf("fetch manifest of %s:%s, %s", m.Manifest.Image.Name, m.Manifest.Image.Tag, m.Status.Message)
+			statuses = append(statuses, m.Status)
+		}
+		log.Errorf("Fetch images manifest with errors.")
+		return statusExitCode(_exitFailure, statuses...)
+	}
+	err = generateManifestFile(allManifest)
+	if err != nil {
+		log.Errorf("manifest file %v.", err)
+		return _exitFailure
+	}
+
+	log.Infof("Total size of the images: %s.", utils.HumanSize(mcr.TotalSize))
+	if !checkDiskSpace(allManifest) {
+		return _exitFailure
+	}
+
+	failed := downloadImages(ctx, allManifest, mcr.Required)
+	if ctx.Err() != nil {
+		log.Warnf("The download is interrupted, the downloaded blobs are recorded in %s.", filepath.Join(ImageDateFolderPath, _defaultDownloadManifest))
+		return _exitInterrupted
+	}
+	if len(failed) > 0 {
+		log.Errorf("Download images with %d error(s).", len(failed))
+		return statusExitCode(_exitPartial, failed...)
+	}
+	log.Infof("Successfully downloaded the images to %s.", ImageDateFolderPath)
+	return _exitSuccess
+}
+
+func unlockDownload() {
+	_ = filelock.UnLock(filepath.Join(ImageDateFolderPath, _defaultDownloadLock))
+	_ = filelock.UnLock(downloadLockFile)
+}
+
+// _lockScopeImageSet is the scope of the process lock of download only, one
+// download per image set.
+const _lockScopeImageSet = "image-set"
+
+// downloadProcessLockFile returns the path of the process lock file of the
+// scope of '--lock-scope'.
+func downloadProcessLockFile() (string, error) {
+	switch downloadConfig.LockScope {
+	case _lockScopeGlobal, _lockScopeDir:
+		return processLockFile(downloadConfig.LockScope, _defaultDownloadLock, downloadConfig.Dir)
+	case _lockScopeImageSet:
+		// e.g. images.download.5f2c6b1e9a0d.lock
+		sum := sha256.Sum256([]byte(downloadImageSetKey()))
+		ext := filepath.Ext(_defaultDownloadLock)
+		return filepath.Join(_defaultBaseDir, fmt.Sprintf("%s.%x%s", strings.TrimSuffix(_defaultDownloadLock, ext), sum[:6], ext)), nil
+	}
+	return "", fmt.Errorf("invalid --lock-scope %q, want global, dir or image-set", downloadConfig.LockScope)
+}
+
+// downloadImageSetKey identifies the image set of the download for the
+// image-set scope of the process lock, the catalog downloads are identified
+// by the registry and the filters.
+func downloadImageSetKey() string {
+	if downloadConfig.Catalog {
+		return strings.Join([]string{"catalog", downloadConfig.Registry, downloadConfig.Org, downloadConfig.RepoRegex}, " ")
+	}
+	if abs, err := filepath.Abs(downloadConfig.ImagesSet); err == nil {
+		return abs
+	}
+	return downloadConfig.ImagesSet
+}
+
 func checkImageSet(name string) bool {
 	return utils.PathIsExist(name)
 }
@@ -215,36 +384,109 @@ func generateDownloadManifest(dms []*DownloadManifest) error {
 	return nil
 }
 
-func fetchAllManifest(imageSet *images.ImageSet) []ManifestResponse {
+func generateBaseFile(baseDir string) error {
+	err := ioutil.WriteFile(filepath.Join(ImageDateFolderPath, _defaultDownloadBase), []byte(baseDir), 0644)
+	if err != nil {
+		return fmt.Errorf("write %v", err)
+	}
+	return nil
+}
+
+// loadBaseBundle reads the download manifest of a previous bundle, since can be
+// the bundle directory or its manifest file. It returns the bundle directory and
+// the path of every blob that was downloaded successfully, keyed by digest.
+func loadBaseBundle(since string) (string, map[string]string, error) {
+	file := since
+	if utils.IsDir(since) {
+		file = filepath.Join(since, _defaultDownloadManifest)
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return "", nil, err
+	}
+	dms, err := getImagesDownloadManifest(file)
+	if err != nil {
+		return "", nil, err
+	}
+	blobs := make(map[string]string)
+	add := func(l LayerResponse) {
+		if l.Status == nil || l.Status.Code != client.OK.Code {
+			return
+		}
+		if target := resolveBlobTarget(dir, l.Target); target != "" {
+			blobs[l.Digest] = target
+		}
+	}
+	for _, m := range dms {
+		add(m.Config)
+		for _, l := range m.Layers {
+			add(l)
+		}
+	}
+	return dir, blobs, nil
+}
+
+// fetchAllManifest fetches the manifests of the entries concurrently, the
+// responses are in the order of the entries.
+func fetchAllManifest(ctx context.Context, imageSet *images.ImageSet) []ManifestResponse {
 	var wg sync.WaitGroup
-	var manifests []ManifestResponse
-	wg.Add(len(imageSet.Images))
-	for _, i := range imageSet.Images {
-		go func(i string) {
+	// each goroutine writes its own element, so no lock is required
+	manifests := make([]ManifestResponse, len(imageSet.Entries))
+	wg.Add(len(imageSet.Entries))
+	for i, e := range imageSet.Entries {
+		go func(i int, e images.Entry) {
 			defer wg.Done()
-			img := images.ParseImage(i, imageSet.OrgName)
-			manifest, err := c.FetchManifest(img.Name, img.Tag)
-			log.Debugf("fetch manifest: %s:%s, status: %d, %s.", img.Name, img.Tag, err.Code, err.Message)
-			manifests = append(manifests, ManifestResponse{err, manifest})
-		}(i)
+			manifest, err := fetchManifest(ctx, e)
+			log.Debugf("fetch manifest: %s, status: %d, %s.", e, err.Code, err.Message)
+			manifests[i] = ManifestResponse{err, manifest}
+		}(i, e)
 	}
 	wg.Wait()
 	return manifests
 }
 
-func downloadImages(manifests []ManifestResponse, required *sync.Map, completedc chan int) {
+// fetchManifest fetches the manifest of an image set entry from its registry.
+func fetchManifest(ctx context.Context, entry images.Entry) (*client.Manifest, *client.Errno) {
+	ref, err := entry.Reference()
+	if err != nil {
+		return &client.Manifest{Image: client.ImageRepo{Name: entry.Image}}, &client.Errno{Code: client.BadRequestErr.Code, Message: err.Error()}
+	}
+	if d, ok := lockedDigests[lockReference(ref)]; ok {
+		ref.Digest = d
+	}
+	repo := client.ImageRepo{Registry: ref.Domain, Name: ref.Path, Tag: ref.Tag, Digest: ref.Digest}
+	if entry.Pattern != nil {
+		repo.Pattern = entry.Pattern.String()
+	}
+	cli, err := registryClient(ctx, ref.Domain)
+	if err != nil {
+		return &client.Manifest{Image: repo}, &client.Errno{Code: client.InternalServerErr.Code, Message: err.Error()}
+	}
+	manifest, status := cli.FetchManifest(ctx, ref.Path, ref.Reference())
+	manifest.Image = repo
+	return manifest, status
+}
+
+// downloadImages downloads the blobs of the manifests and writes the download
+// manifest, it returns the statuses of the failed blobs.
+func downloadImages(ctx context.Context, manifests []ManifestResponse, required *sync.Map) []*client.Errno {
 	var wg sync.WaitGroup
-	var dms []*DownloadManifest
+	dms := make([]*DownloadManifest, len(manifests))
 	log.Debugf("download blobs with %d goroutines.", len(manifests))
 	wg.Add(len(manifests))
-	uiprogress.Start()
-	for _, m := range manifests {
-		bar := addProgressBar(len(m.Manifest.Layers), m.Manifest.Image)
-		go func(m ManifestResponse, bar2 *uiprogress.Bar) {
+	progress.Start()
+	var total int64
+	required.Range(func(_, v interface{}) bool {
+		total += v.(*RequiredLayer).Layer.Size
+		return true
+	})
+	totalBar := addTotalProgressBar(total)
+	for i, m := range manifests {
+		bar := addProgressBar(manifestSize(m.Manifest), m.Manifest.Image)
+		go func(i int, m ManifestResponse, bar2 *progress.Bar) {
 			defer wg.Done()
-			dm := fetchLayersOfManifest(m, required, bar2)
-			dms = append(dms, dm)
-		}(m, bar)
+			dms[i] = fetchLayersOfManifest(ctx, m, required, bar2, totalBar)
+		}(i, m, bar)
 	}
 	wg.Wait()
 	log.Debug("download blobs completed.")
@@ -252,41 +494,113 @@ func downloadImages(manifests []ManifestResponse, required *sync.Map, completedc
 	if err != nil {
 		log.Errorf("generate manifest %v.", err)
 	}
-	uiprogress.Stop()
-	failed := checkFetchBlobsResult(dms)
-	completedc <- failed
+	progress.Stop()
+	log.Infof("Transferred: %s, deduplicated: %s, skipped: %s.",
+		utils.HumanSize(downloadStats.Transferred), utils.HumanSize(downloadStats.Deduplicated), utils.HumanSize(downloadStats.Skipped))
+	return checkFetchBlobsResult(dms)
+}
+
+func manifestSize(m *client.Manifest) int64 {
+	size := m.Config.Size
+	for _, l := range m.Layers {
+		size += l.Size
+	}
+	return size
 }
 
-func fetchConfigOfManifest(mr ManifestResponse) (string, *client.Errno) {
-	target := fmt.Sprintf("%s/%s.json", ImageDateFolderPath, strings.Split(mr.Manifest.Config.Digest, ":")[1])
-	err := c.FetchBlobs(mr.Manifest.Image.Name, mr.Manifest.Config.Digest, target)
-	return target, err
+func blobTarget(digest, ext string) string {
+	s := strings.Split(digest, ":")
+	return filepath.Join(ImageDateFolderPath, s[len(s)-1]+ext)
+}
+
+// fetchRequiredBlob fetches the blob once, if the blob is required by other
+// images, they wait for it and share the result.
+func fetchRequiredBlob(ctx context.Context, image client.ImageRepo, l client.Layer, target string, required *sync.Map, bar, totalBar *progress.Bar) (string, *client.Errno) {
+	v, _ := required.LoadOrStore(l.Digest, &RequiredLayer{Layer: l})
+	rl := v.(*RequiredLayer)
+	fetched := false
+	rl.once.Do(func() {
+		fetched = true
+		rl.target, rl.status = fetchBlob(ctx, image, l, target, bar, totalBar)
+	})
+	if !fetched {
+		downloadStats.AddDeduplicated(l.Size)
+		bar.Add(l.Size)
+	}
+	return rl.target, rl.status
 }
 
-func fetchLayersOfManifest(mr ManifestResponse, required *sync.Map, bar *uiprogress.Bar) *DownloadManifest {
+// fetchBlob gets the blob from the base bundle or the shared cache if it is
+// there, otherwise downloads it from the registry and adds it to the cache.
+// It returns the path of the blob.
+func fetchBlob(ctx context.Context, image client.ImageRepo, l client.Layer, target string, bars ...*progress.Bar) (string, *client.Errno) {
+	skip := func() {
+		downloadStats.AddSkipped(l.Size)
+		for _, b := range bars {
+			b.Add(l.Size)
+		}
+	}
+	if base, ok := baseBlobs[l.Digest]; ok {
+		skip()
+		return base, client.OK
+	}
+	if blobCache != nil && blobCache.Has(l.Digest) {
+		err := blobCache.Link(l.Digest, target)
+		if err == nil {
+			log.Debugf("fetch blobs %s of %s from cache.", l.Digest, image.Name)
+			skip()
+			return target, client.OK
+		}
+		log.Debugf("link cached blobs %s: %v.", l.Digest, err)
+	}
+	cli, err := registryClient(ctx, image.Registry)
+	if err != nil {
+		return target, &client.Errno{Code: client.InternalServerErr.Code, Message: err.Error()}
+	}
+	status := cli.FetchBlobs(ctx, image.Name, l.Digest, target, func(n int64) {
+		downloadStats.AddTransferred(n)
+		for _, b := range bars {
+			b.Add(n)
+		}
+	})
+	if status.Code == client.OK.Code && blobCache != nil {
+		if err := blobCache.Put(l.Digest, target); err != nil {
+			log.Debugf("cache blobs %s: %v.", l.Digest, err)
+		}
+	}
+	return target, status
+}
+
+// saveManifestContent writes the manifest content to the download directory.
+func saveManifestContent(m *client.Manifest) LayerResponse {
+	target := blobTarget(m.Digest, ".manifest.json")
+	status := client.OK
+	if err := ioutil.WriteFile(target, m.Raw, 0644); err != nil {
+		status = &client.Errno{Code: client.InternalServerErr.Code, Message: err.Error()}
+	}
+	log.Debugf("save manifest of %s:%s, status: %d, %s.", m.Image.Name, m.Image.Tag, status.Code, status.Message)
+	return LayerResponse{status, m.Digest, target}
+}
+
+func fetchLayersOfManifest(ctx context.Context, mr ManifestResponse, required *sync.Map, bar, totalBar *progress.Bar) *DownloadManifest {
 	var wg sync.WaitGroup
 	log.Debugf("fetch config of manifest: %s:%s.", mr.Manifest.Image.Name, mr.Manifest.Image.Tag)
 	lm := &DownloadManifest{Image: mr.Manifest.Image}
-	conf, err := fetchConfigOfManifest(mr)
+	lm.Manifest = saveManifestContent(mr.Manifest)
+	conf := mr.Manifest.Config
+	target, err := fetchRequiredBlob(ctx, mr.Manifest.Image, conf, blobTarget(conf.Digest, ".json"), required, bar, totalBar)
 	log.Debugf("fetch config of manifest: %s:%s, status: %d, %s.", mr.Manifest.Image.Name, mr.Manifest.Image.Tag, err.Code, err.Message)
-	lm.Config = LayerResponse{err, mr.Manifest.Config.Digest,conf}
-	for _, l := range mr.Manifest.Layers {
-		v, _ := required.Load(l.Digest)
-		s, _ := v.(RequiredLayer)
-		target := fmt.Sprintf("%s/%s.tar.gz", ImageDateFolderPath, strings.Split(l.Digest, ":")[1])
-		if s.Fetched == true {
-			lm.Layers = append(lm.Layers, LayerResponse{client.OK, l.Digest, target})
-			bar.Incr()
-			continue
-		}
+	lm.Config = LayerResponse{err, conf.Digest, target}
+	// the layers are in the order of the manifest
+	lm.Layers = make([]LayerResponse, len(mr.Manifest.Layers))
+	for i, l := range mr.Manifest.Layers {
 		wg.Add(1)
-		go func(l client.Layer, t string) {
+		go func(i int, l client.Layer) {
 			defer wg.Done()
-			err := c.FetchBlobs(mr.Manifest.Image.Name, l.Digest, t)
+			t, err := fetchRequiredBlob(ctx, mr.Manifest.Image, l, blobTarget(l.Digest, ".tar.gz"), required, bar, totalBar)
 			log.Debugf("fetch blobs %s of %s, status: %d, %s.", l.Digest, mr.Manifest.Image.Name, err.Code, err.Message)
-			lm.Layers = append(lm.Layers, LayerResponse{err, l.Digest, t})
-			bar.Incr()
-		}(l, target)
+			lm.Layers[i] = LayerResponse{err, l.Digest, t}
+		}(i, l)
 	}
 	wg.Wait()
 	return lm
@@ -302,23 +616,86 @@ func checkFetchManifestResult(manifests []ManifestResponse) *ManifestCheckResult
 		if len(m.Manifest.Layers) < 1 {
 			continue
 		}
-		for _, l := range m.Manifest.Layers {
-			mcr.TotalSize += int(math.Ceil(float64(l.Size / 1024 / 1024)))
-			mcr.Required.LoadOrStore(l.Digest, RequiredLayer{false, l, m.Manifest.Image})
+		blobs := append([]client.Layer{m.Manifest.Config}, m.Manifest.Layers...)
+		for _, l := range blobs {
+			if _, loaded := mcr.Required.LoadOrStore(l.Digest, &RequiredLayer{Layer: l, Image: m.Manifest.Image}); !loaded {
+				mcr.TotalSize += l.Size
+			}
 		}
 	}
 	return mcr
 }
 
-func checkFetchBlobsResult(dms []*DownloadManifest) int {
-	var failed int
+// requiredSpace returns the bytes to download, each blob is counted once and
+// the blobs that are in the base bundle, the blob cache or the download
+// directory already are not counted.
+func requiredSpace(manifests []ManifestResponse) int64 {
+	var size int64
+	counted := make(map[string]bool)
+	add := func(l client.Layer, ext string) {
+		if counted[l.Digest] {
+			return
+		}
+		counted[l.Digest] = true
+		if _, ok := baseBlobs[l.Digest]; ok {
+			return
+		}
+		if blobCache != nil && blobCache.Has(l.Digest) {
+			return
+		}
+		if utils.PathIsExist(blobTarget(l.Digest, ext)) {
+			return
+		}
+		size += l.Size
+	}
+	for _, m := range manifests {
+		if m.Manifest == nil {
+			continue
+		}
+		add(m.Manifest.Config, ".json")
+		for _, l := range m.Manifest.Layers {
+			add(l, ".tar.gz")
+		}
+	}
+	return size
+}
+
+func checkDiskSpace(manifests []ManifestResponse) bool {
+	required := requiredSpace(manifests)
+	free, err := utils.DiskFree(ImageDateFolderPath)
+	if err != nil {
+		log.Warnf("Warning: cannot check the disk space: %v, please make sure you have enough disk space for downloading images.", err)
+		return true
+	}
+	log.Infof("Required disk space: %s, available: %s.", utils.HumanSize(required), utils.HumanSize(int64(free)))
+	if uint64(required) <= free {
+		return true
+	}
+	if downloadConfig.IgnoreSpace {
+		log.Warn("Warning: Not enough disk space, the space check is ignored.")
+		return true
+	}
+	log.Errorf("Not enough disk space in %s, %s is required but only %s is available.",
+		ImageDateFolderPath, utils.HumanSize(required), utils.HumanSize(int64(free)))
+	log.Error("Free up some space or use '--ignore-space-check' to skip the check.")
+	return false
+}
+
+// checkFetchBlobsResult returns the statuses of the failed blobs.
+func checkFetchBlobsResult(dms []*DownloadManifest) []*client.Errno {
+	var failed []*client.Errno
 	for _, m := range dms {
+		if !isStatusOK(m.Manifest.Status) {
+			failed = append(failed, m.Manifest.Status)
+		} else if !isStatusOK(m.Config.Status) {
+			failed = append(failed, m.Config.Status)
+		}
 		if len(m.Layers) < 1 {
 			continue
 		}
 		for _, l := range m.Layers {
 			if l.Status.Code != client.OK.Code {
-				failed ++
+				failed = append(failed, l.Status)
 			}
 		}
 	}
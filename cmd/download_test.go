@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+	"github.com/shipengqi/lighting-i/pkg/images"
+	"github.com/shipengqi/lighting-i/pkg/log"
+	"github.com/shipengqi/lighting-i/pkg/progress"
+)
+
+// setupDownload points the client to the registry r and returns a new
+// download directory, the caller removes it.
+func setupDownload(t *testing.T, r *registrytest.Registry) string {
+	if err := progress.SetMode(progress.ModeNone); err != nil {
+		t.Fatal(err)
+	}
+	Conf.Registry, Conf.User, Conf.Password = r.URL, "", ""
+	if err := initClient(context.Background()); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	dir, err := ioutil.TempDir("", "lighting-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ImageDateFolderPath, blobCache, baseBlobs, lockedDigests = dir, nil, nil, nil
+	downloadStats = TransferStats{}
+	return dir
+}
+
+// fetchImageSet fetches the manifests of the images, it fails if any of them
+// fails.
+func fetchImageSet(t *testing.T, entries ...string) ([]ManifestResponse, *ManifestCheckResult) {
+	imageSet := &images.ImageSet{}
+	for _, e := range entries {
+		imageSet.Entries = append(imageSet.Entries, images.Entry{Image: e})
+	}
+	allManifest := fetchAllManifest(context.Background(), imageSet)
+	mcr := checkFetchManifestResult(allManifest)
+	if len(mcr.Failed) > 0 {
+		t.Fatalf("Wanted no failed manifest, got %s", mcr.Failed[0].Status.Message)
+	}
+	return allManifest, mcr
+}
+
+// addImages adds n images sharing the base layer to the registry, it returns
+// the references of the images.
+func addImages(r *registrytest.Registry, n int) []string {
+	var refs []string
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("shipengqi/app%d", i)
+		r.AddImage(name, "v1.0.0", []byte("base layer"), []byte(name+" layer 1"), []byte(name+" layer 2"))
+		refs = append(refs, name+":v1.0.0")
+	}
+	return refs
+}
+
+func TestDownloadImages(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	refs := addImages(r, 8)
+	dir := setupDownload(t, r)
+	defer os.RemoveAll(dir)
+
+	t.Run("Download images", func(t *testing.T) {
+		allManifest, mcr := fetchImageSet(t, refs...)
+		if len(allManifest) != len(refs) {
+			t.Fatalf("Wanted %d manifests, got %d", len(refs), len(allManifest))
+		}
+		for i, m := range allManifest {
+			if name := m.Manifest.Image.Name + ":" + m.Manifest.Image.Tag; name != refs[i] {
+				t.Fatalf("Wanted %s, got %s", refs[i], name)
+			}
+		}
+		if failed := downloadImages(context.Background(), allManifest, mcr.Required); len(failed) != 0 {
+			t.Fatalf("Wanted no failed blobs, got %v", failed)
+		}
+		dms, err := getImagesDownloadManifest(filepath.Join(dir, _defaultDownloadManifest))
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if len(dms) != len(refs) {
+			t.Fatalf("Wanted %d images, got %d", len(refs), len(dms))
+		}
+		for i, dm := range dms {
+			layers := allManifest[i].Manifest.Layers
+			if len(dm.Layers) != len(layers) {
+				t.Fatalf("Wanted %d layers, got %d", len(layers), len(dm.Layers))
+			}
+			for j, l := range dm.Layers {
+				if l.Digest != layers[j].Digest || l.Status.Code != client.OK.Code {
+					t.Fatalf("Wanted layer %s, got %s: %d", layers[j].Digest, l.Digest, l.Status.Code)
+				}
+			}
+		}
+	})
+
+	t.Run("Count the failed blobs", func(t *testing.T) {
+		blobs, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+		for _, b := range blobs {
+			_ = os.Remove(b)
+		}
+		allManifest, mcr := fetchImageSet(t, refs...)
+		r.AddFault(registrytest.Fault{Method: http.MethodGet, Path: regexp.QuoteMeta(registrytest.Digest([]byte("base layer"))), Status: http.StatusNotFound})
+		// every image fails on the shared base layer
+		if failed := downloadImages(context.Background(), allManifest, mcr.Required); len(failed) != len(refs) {
+			t.Fatalf("Wanted %d failed blobs, got %d", len(refs), len(failed))
+		}
+	})
+}
+
+func TestDownloadInterrupted(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("base layer"), []byte("app layer"))
+	dir := setupDownload(t, r)
+	defer os.RemoveAll(dir)
+	allManifest, mcr := fetchImageSet(t, "shipengqi/apiserver:v1.0.0")
+
+	r.AddFault(registrytest.Fault{Method: http.MethodGet, Path: "/blobs/", Delay: 300 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if failed := downloadImages(ctx, allManifest, mcr.Required); len(failed) == 0 {
+		t.Fatalf("Wanted failed blobs, got 0")
+	}
+
+	dms, err := getImagesDownloadManifest(filepath.Join(dir, _defaultDownloadManifest))
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	if len(dms) != 1 || dms[0].Config.Status.Code != client.CanceledErr.Code {
+		t.Fatalf("Wanted the canceled config in the download manifest, got %+v", dms)
+	}
+	blobs, _ := filepath.Glob(filepath.Join(dir, "*.tar.gz"))
+	if len(blobs) != 0 {
+		t.Fatalf("Wanted no partial blobs, got %v", blobs)
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	refs := addImages(r, 3)
+	dir := setupDownload(t, r)
+	defer os.RemoveAll(dir)
+
+	// capture stdout, the messages printed to the console and the JSON
+	// progress are written to it unless they are redirected
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, out := os.Stdout, progress.Out
+	os.Stdout, progress.Out = wr, wr
+	defer func() {
+		os.Stdout, progress.Out = stdout, out
+		log.SetConsole(nil)
+	}()
+	captured := make(chan []byte)
+	go func() {
+		data, _ := ioutil.ReadAll(rd)
+		captured <- data
+	}()
+
+	if err = initProgress(progress.ModeJSON); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	if err = initClient(context.Background()); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	allManifest, mcr := fetchImageSet(t, refs...)
+	if failed := downloadImages(context.Background(), allManifest, mcr.Required); len(failed) != 0 {
+		t.Fatalf("Wanted no failed blobs, got %v", failed)
+	}
+	_ = wr.Close()
+	lines := strings.Split(strings.TrimSpace(string(<-captured)), "\n")
+	if len(lines) < len(refs) {
+		t.Fatalf("Wanted at least %d events, got %q", len(refs), lines)
+	}
+	for _, l := range lines {
+		var e progress.Event
+		if err := json.Unmarshal([]byte(l), &e); err != nil {
+			t.Fatalf("Wanted a JSON event, got %q: %v", l, err)
+		}
+	}
+}
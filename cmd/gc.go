@@ -0,0 +1,258 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/filelock"
+	"github.com/shipengqi/lighting-i/pkg/utils"
+)
+
+var (
+	_runStateRunning    = "running"
+	_runStateSucceeded  = "succeeded"
+	_runStateFailed     = "failed"
+	_runStateIncomplete = "incomplete"
+)
+
+type GCConfig struct {
+	Dir        string
+	MaxAge     time.Duration
+	Keep       int
+	FailedOnly bool
+	DryRun     bool
+}
+
+// DownloadRun is a download directory created by 'download'.
+type DownloadRun struct {
+	Path    string
+	Created time.Time
+	Size    int64
+	Images  int
+	State   string
+	Base    string
+}
+
+var gcConfig GCConfig
+
+func addGCFlags(flagSet *pflag.FlagSet) {
+	flagSet.StringVarP(&gcConfig.Dir, "dir", "d", _defaultImagesDir, "Images tar directory path.")
+	flagSet.DurationVar(&gcConfig.MaxAge, "max-age", 0, "Delete the download directories older than this, e.g. 720h.")
+	flagSet.IntVar(&gcConfig.Keep, "keep", -1, "Keep this number of the newest download directories, delete the others.")
+	flagSet.BoolVar(&gcConfig.FailedOnly, "failed-only", false, "If true, delete the failed and incomplete download directories only.")
+	flagSet.BoolVar(&gcConfig.DryRun, "dry-run", false, "If true, only print the download directories that would be deleted.")
+}
+
+func gcCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   _defaultGCCommand,
+		Short: "List and prune old download directories.",
+		Long: "List the download directories with their size, image count and state. " +
+			"Directories are deleted if '--max-age', '--keep' or '--failed-only' is set, " +
+			"the directories being downloaded or uploaded and the bases of other directories are never deleted.",
+		Run: func(cmd *cobra.Command, args []string) {
+			runs, err := listDownloadRuns(gcConfig.Dir)
+			if err != nil {
+				fmt.Printf("list %v\n", err)
+				os.Exit(1)
+			}
+			printDownloadRuns(runs)
+			if gcConfig.MaxAge <= 0 && gcConfig.Keep < 0 && !gcConfig.FailedOnly {
+				return
+			}
+
+			var failed int
+			var freed int64
+			for _, r := range selectDownloadRuns(runs, gcConfig) {
+				if gcConfig.DryRun {
+					fmt.Printf("would delete: %s\n", r.Path)
+					freed += r.Size
+					continue
+				}
+				if err := removeDownloadRun(r.Path); err != nil {
+					if _, ok := err.(*filelock.LockedError); ok {
+						fmt.Printf("skip: %s is locked.\n", r.Path)
+						continue
+					}
+					fmt.Printf("delete %v\n", err)
+					failed++
+					continue
+				}
+				fmt.Printf("deleted: %s\n", r.Path)
+				freed += r.Size
+			}
+			fmt.Printf("Total reclaimed space: %s\n", utils.HumanSize(freed))
+			if failed > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().SortFlags = false
+	addGCFlags(cmd.Flags())
+	return cmd
+}
+
+// listDownloadRuns returns the download directories under dir, the newest first.
+func listDownloadRuns(dir string) ([]*DownloadRun, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var runs []*DownloadRun
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		created, err := time.ParseInLocation("20060102150405", fi.Name(), time.Local)
+		if err != nil {
+			continue
+		}
+		runs = append(runs, inspectDownloadRun(filepath.Join(dir, fi.Name()), created))
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].Created.After(runs[j].Created)
+	})
+	return runs, nil
+}
+
+func inspectDownloadRun(p string, created time.Time) *DownloadRun {
+	r := &DownloadRun{Path: p, Created: created, State: _runStateIncomplete}
+	_ = filepath.Walk(p, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			r.Size += fi.Size()
+		}
+		return nil
+	})
+	if base, err := ioutil.ReadFile(filepath.Join(p, _defaultDownloadBase)); err == nil {
+		r.Base = strings.TrimSpace(string(base))
+	}
+
+	var mrs []ManifestResponse
+	if data, err := ioutil.ReadFile(filepath.Join(p, _defaultManifestJson)); err == nil {
+		if json.Unmarshal(data, &mrs) == nil {
+			r.Images = len(mrs)
+		}
+	}
+	dms, err := getImagesDownloadManifest(filepath.Join(p, _defaultDownloadManifest))
+	if err == nil {
+		r.Images = len(dms)
+		r.State = _runStateSucceeded
+		for _, m := range dms {
+			if !isStatusOK(m.Config.Status) {
+				r.State = _runStateFailed
+			}
+			for _, l := range m.Layers {
+				if !isStatusOK(l.Status) {
+					r.State = _runStateFailed
+				}
+			}
+		}
+	} else {
+		for _, m := range mrs {
+			if !isStatusOK(m.Status) {
+				r.State = _runStateFailed
+			}
+		}
+	}
+
+	if filelock.Check(filepath.Join(p, _defaultDownloadLock)) || filelock.Check(filepath.Join(p, _defaultUploadLock)) {
+		r.State = _runStateRunning
+	}
+	return r
+}
+
+// removeDownloadRun deletes the download directory. The download and upload
+// locks of the directory are held while deleting, so a download or an upload
+// cannot start in it, the lock files are removed last when they are released.
+func removeDownloadRun(dir string) error {
+	var locks []string
+	defer func() {
+		for _, l := range locks {
+			_ = filelock.UnLock(l)
+		}
+	}()
+	for _, name := range []string{_defaultDownloadLock, _defaultUploadLock} {
+		l := filepath.Join(dir, name)
+		if err := filelock.Lock(l); err != nil {
+			return err
+		}
+		locks = append(locks, l)
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.Name() == _defaultDownloadLock || fi.Name() == _defaultUploadLock {
+			continue
+		}
+		if err = os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	for _, l := range locks {
+		if err = filelock.UnLock(l); err != nil {
+			return err
+		}
+	}
+	locks = nil
+	return os.Remove(dir)
+}
+
+// selectDownloadRuns returns the runs to delete, runs must be sorted newest first.
+func selectDownloadRuns(runs []*DownloadRun, conf GCConfig) []*DownloadRun {
+	bases := make(map[string]string)
+	for _, r := range runs {
+		if r.Base != "" {
+			bases[filepath.Clean(r.Base)] = r.Path
+		}
+	}
+	var selected []*DownloadRun
+	for i, r := range runs {
+		if conf.Keep >= 0 && i < conf.Keep {
+			continue
+		}
+		if conf.MaxAge > 0 && time.Since(r.Created) <= conf.MaxAge {
+			continue
+		}
+		if conf.FailedOnly && r.State != _runStateFailed && r.State != _runStateIncomplete {
+			continue
+		}
+		if r.State == _runStateRunning {
+			fmt.Printf("skip: %s is locked.\n", r.Path)
+			continue
+		}
+		if abs, err := filepath.Abs(r.Path); err == nil {
+			if delta, ok := bases[abs]; ok {
+				fmt.Printf("skip: %s is the base of %s.\n", r.Path, delta)
+				continue
+			}
+		}
+		selected = append(selected, r)
+	}
+	return selected
+}
+
+func printDownloadRuns(runs []*DownloadRun) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DIRECTORY\tCREATED\tSIZE\tIMAGES\tSTATE")
+	for _, r := range runs {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", r.Path, r.Created.Format("2006-01-02 15:04:05"), utils.HumanSize(r.Size), r.Images, r.State)
+	}
+	_ = w.Flush()
+}
+
+func isStatusOK(status *client.Errno) bool {
+	return status != nil && status.Code == client.OK.Code
+}
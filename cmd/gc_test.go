@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shipengqi/lighting-i/pkg/filelock"
+)
+
+func TestRemoveDownloadRun(t *testing.T) {
+	newRun := func(t *testing.T) string {
+		dir, err := ioutil.TempDir("", "lighting-gc")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(filepath.Join(dir, _defaultDownloadManifest), []byte("[]"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	t.Run("Remove the directory", func(t *testing.T) {
+		dir := newRun(t)
+		defer os.RemoveAll(dir)
+		if err := removeDownloadRun(dir); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Fatalf("Wanted the directory removed, got %v", err)
+		}
+	})
+
+	t.Run("Skip the directory being uploaded", func(t *testing.T) {
+		dir := newRun(t)
+		defer os.RemoveAll(dir)
+		lock := filepath.Join(dir, _defaultUploadLock)
+		if err := filelock.Lock(lock); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		defer filelock.UnLock(lock)
+		err := removeDownloadRun(dir)
+		if _, ok := err.(*filelock.LockedError); !ok {
+			t.Fatalf("Wanted a locked error, got %v", err)
+		}
+		if _, err = os.Stat(filepath.Join(dir, _defaultDownloadManifest)); err != nil {
+			t.Fatalf("Wanted the manifest kept, got %v", err)
+		}
+		// the lock taken by removeDownloadRun is released
+		if filelock.Check(filepath.Join(dir, _defaultDownloadLock)) {
+			t.Fatal("Wanted the download lock released, got locked")
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/shipengqi/lighting-i/pkg/images"
+	"github.com/shipengqi/lighting-i/pkg/utils"
+)
+
+type ImagesConfig struct {
+	Org     string
+	Version string
+	Output  string
+	EnvFile string
+}
+
+var imagesConfig ImagesConfig
+
+// imageSourceFunc returns the images referenced by the input, path is the path
+// of the input file, or '-' for stdin.
+type imageSourceFunc func(r io.Reader, path string) ([]string, error)
+
+func imagesCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   _defaultImagesCommand,
+		Short: "Generate image sets.",
+		Run: func(cmd *cobra.Command, args []string) {
+			_ = cmd.Help()
+		},
+	}
+	cmd.PersistentFlags().StringVar(&imagesConfig.Org, "org", "", "If set, drop the registry and the namespace of the images, and set the org_name of the image set.")
+	cmd.PersistentFlags().StringVar(&imagesConfig.Version, "version", "", "The version of the image set.")
+	cmd.PersistentFlags().StringVarP(&imagesConfig.Output, "output", "o", "", "Image set file path, default is stdout.")
+	cmd.AddCommand(imagesFromK8sCommand())
+	cmd.AddCommand(imagesFromComposeCommand())
+	return cmd
+}
+
+func imagesFromK8sCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "from-k8s <dir|file|->...",
+		Short: "Generate an image set from Kubernetes manifests.",
+		Long: "Generate an image set from the containers and the init containers of the Pods, Deployments, StatefulSets, " +
+			"DaemonSets, Jobs and CronJobs in Kubernetes manifests, e.g. the output of 'helm template'. The *.yaml, *.yml " +
+			"and *.json files of a directory are read recursively, '-' reads stdin.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			source := func(r io.Reader, _ string) ([]string, error) {
+				return images.FromKubernetes(r)
+			}
+			generateImageSet(args, []string{".yaml", ".yml", ".json"}, source, "Generated by 'lighting images from-k8s'.")
+		},
+	}
+}
+
+func imagesFromComposeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "from-compose <dir|file|->...",
+		Short: "Generate an image set from docker-compose files.",
+		Long: "Generate an image set from the images of the services of docker-compose v2/v3 files. The variables are " +
+			"interpolated from the environment, then the env file. The *.yaml and *.yml files of a directory are read " +
+			"recursively, '-' reads stdin.",
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			generateImageSet(args, []string{".yaml", ".yml"}, composeImages, "Generated by 'lighting images from-compose'.")
+		},
+	}
+	cmd.Flags().StringVar(&imagesConfig.EnvFile, "env-file", "", "Env file path, default is the .env file next to the compose file.")
+	return cmd
+}
+
+// composeImages returns the images of the compose file, the variables are read
+// from '--env-file', or the .env file next to the compose file if it exists.
+func composeImages(r io.Reader, path string) ([]string, error) {
+	envFile := imagesConfig.EnvFile
+	if envFile == "" {
+		dir := "."
+		if path != "-" {
+			dir = filepath.Dir(path)
+		}
+		if f := filepath.Join(dir, ".env"); utils.PathIsExist(f) {
+			envFile = f
+		}
+	}
+	env := make(map[string]string)
+	if envFile != "" {
+		var err error
+		if env, err = images.ReadEnvFile(envFile); err != nil {
+			return nil, err
+		}
+	}
+	return images.FromCompose(r, images.EnvLookup(env))
+}
+
+// generateImageSet reads the images from the inputs and writes the image set,
+// an input is a file, a directory of the files with the extensions, or '-' for
+// stdin.
+func generateImageSet(inputs, exts []string, source imageSourceFunc, header string) {
+	var all []string
+	for _, input := range inputs {
+		found, err := readImageSources(input, exts, source)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		all = append(all, found...)
+	}
+	imageSet, err := images.NewImageSet(all, imagesConfig.Org, imagesConfig.Version)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "generate image set %v\n", err)
+		os.Exit(1)
+	}
+	out := io.Writer(os.Stdout)
+	if imagesConfig.Output != "" {
+		f, err := os.Create(imagesConfig.Output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "create %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	}
+	if err = imageSet.Encode(out, header); err != nil {
+		fmt.Fprintf(os.Stderr, "write image set %v\n", err)
+		os.Exit(1)
+	}
+	if imagesConfig.Output != "" {
+		fmt.Printf("Found %d image(s), written to %s.\n", len(imageSet.Images), imagesConfig.Output)
+	}
+}
+
+func readImageSources(input string, exts []string, source imageSourceFunc) ([]string, error) {
+	if input == "-" {
+		found, err := source(os.Stdin, input)
+		if err != nil {
+			return nil, fmt.Errorf("stdin: %v", err)
+		}
+		return found, nil
+	}
+	var found []string
+	err := filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || (path != input && !hasExt(path, exts)) {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		images, err := source(f, path)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		found = append(found, images...)
+		return nil
+	})
+	return found, err
+}
+
+func hasExt(path string, exts []string) bool {
+	for _, ext := range exts {
+		if strings.EqualFold(filepath.Ext(path), ext) {
+			return true
+		}
+	}
+	return false
+}
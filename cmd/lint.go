@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/shipengqi/lighting-i/pkg/images"
+	"github.com/shipengqi/lighting-i/pkg/log"
+)
+
+type LintConfig struct {
+	ImagesSet string
+	Strict    bool
+}
+
+var lintConfig LintConfig
+
+func lintCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   _defaultLintCommand + " [image set file]...",
+		Short: "Validate the image set files.",
+		Long: "Validate the image set files, report the unknown fields, empty entries and malformed references as errors, " +
+			"and the duplicate images and a missing org_name as warnings.",
+		Run: func(cmd *cobra.Command, args []string) {
+			files := args
+			if len(files) < 1 {
+				files = []string{lintConfig.ImagesSet}
+			}
+			var errs, warnings int
+			for _, f := range files {
+				problems, err := images.Lint(f)
+				if err != nil {
+					fmt.Printf("%s: error: %v\n", f, err)
+					errs++
+					continue
+				}
+				for _, p := range problems {
+					fmt.Println(p)
+					if p.Severity == images.SeverityError {
+						errs++
+					} else {
+						warnings++
+					}
+				}
+			}
+			fmt.Printf("%d error(s), %d warning(s).\n", errs, warnings)
+			if errs > 0 || (lintConfig.Strict && warnings > 0) {
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().SortFlags = false
+	cmd.Flags().StringVarP(&lintConfig.ImagesSet, "image-set", "i", _defaultImageSet, "Images set file path, used if no file is given.")
+	cmd.Flags().BoolVar(&lintConfig.Strict, "strict", false, "If true, fail on warnings too.")
+	return cmd
+}
+
+// checkImageSetWarnings logs the warnings of the image set, it returns false
+// if strict is true and there is any warning.
+func checkImageSetWarnings(imageSet *images.ImageSet, strict bool) bool {
+	for _, w := range imageSet.Warnings {
+		log.Warnf("Warning: %s", w)
+	}
+	if strict && len(imageSet.Warnings) > 0 {
+		log.Errorf("get images %d warning(s) with --strict.", len(imageSet.Warnings))
+		return false
+	}
+	return true
+}
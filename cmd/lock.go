@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/images"
+	"github.com/shipengqi/lighting-i/pkg/log"
+)
+
+type LockConfig struct {
+	User       string
+	Password   string
+	Auths      []string
+	RetryTimes int
+	Registry   string
+	ImagesSet  string
+	Strict     bool
+	Output     string
+}
+
+var lockConfig LockConfig
+
+func addLockFlags(flagSet *pflag.FlagSet) {
+	flagSet.StringVarP(&lockConfig.Registry, "registry", "r", "https://registry-1.docker.io", "The host of the registry.")
+	flagSet.StringVarP(&lockConfig.ImagesSet, "image-set", "i", _defaultImageSet, "Images set file path.")
+	flagSet.BoolVar(&lockConfig.Strict, "strict", false, "If true, fail on the warnings of the image set too, e.g. the duplicate images.")
+	flagSet.StringVarP(&lockConfig.Output, "output", "o", "", "Lock file path, default is <image-set>.lock.yaml.")
+	flagSet.StringVarP(&lockConfig.User, "user", "u", "", "Registry account username.")
+	flagSet.StringVarP(&lockConfig.Password, "pass", "p", "", "Registry account password.")
+	flagSet.StringArrayVar(&lockConfig.Auths, "auth", nil, "Credential of another registry in the image set, in the form of <host>=<username>:<password>, can be repeated.")
+	flagSet.IntVarP(&lockConfig.RetryTimes, "retry", "t", 0, "The retry times when the request fails.")
+}
+
+func lockCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   _defaultLockCommand,
+		Short: "Resolve the images of the image set to their digests and write a lock file.",
+		PreRun: func(cmd *cobra.Command, args []string) {
+			// Init Conf
+			Conf.RetryTimes = lockConfig.RetryTimes
+			Conf.Registry = lockConfig.Registry
+			Conf.User = lockConfig.User
+			Conf.Password = lockConfig.Password
+			Conf.Auths = lockConfig.Auths
+			if lockConfig.Output == "" {
+				lockConfig.Output = images.LockFileName(lockConfig.ImagesSet)
+			}
+			LogFilePath = filepath.Join(filepath.Dir(lockConfig.Output), _defaultLockLog)
+			log.Init(LogFilePath)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			exitWith(runLock)
+		},
+	}
+	cmd.Flags().SortFlags = false
+	addLockFlags(cmd.Flags())
+	return cmd
+}
+
+// runLock resolves the images and writes the lock file, it returns the exit
+// code.
+func runLock(ctx context.Context) int {
+	imageSet, err := images.GetImagesFromSet(lockConfig.ImagesSet)
+	if err != nil {
+		log.Errorf("get images %v.", err)
+		return _exitInvalidInput
+	}
+	if !checkImageSetWarnings(imageSet, lockConfig.Strict) {
+		return _exitInvalidInput
+	}
+	if err = initClient(ctx); err != nil {
+		log.Errorf("init client %v.", err)
+		return errorExitCode(err)
+	}
+	imageSet.Entries, err = resolveTagPatterns(ctx, imageSet.Entries)
+	if err != nil {
+		log.Errorf("resolve tag patterns %v.", err)
+		return errorExitCode(err)
+	}
+
+	lf, failed := lockImageSet(ctx, imageSet)
+	if ctx.Err() != nil {
+		log.Warnf("The lock is interrupted.")
+		return _exitInterrupted
+	}
+	if len(failed) > 0 {
+		log.Errorf("Resolve images with %d error(s).", len(failed))
+		log.Infof("You can refer to %s for more detail.", LogFilePath)
+		return statusExitCode(_exitFailure, failed...)
+	}
+	lf.ImageSet = filepath.Base(lockConfig.ImagesSet)
+	if err = lf.Write(lockConfig.Output); err != nil {
+		log.Errorf("write lock file %v.", err)
+		return _exitFailure
+	}
+	log.Infof("Successfully locked %d image(s) to %s.", len(lf.Images), lockConfig.Output)
+	return _exitSuccess
+}
+
+// lockImageSet resolves every image of the image set to its manifest digest,
+// it returns the lock file and the statuses of the images failed to resolve.
+func lockImageSet(ctx context.Context, imageSet *images.ImageSet) (*images.LockFile, []*client.Errno) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var failed []*client.Errno
+	lf := &images.LockFile{Images: make([]images.LockedImage, len(imageSet.Entries))}
+	wg.Add(len(imageSet.Entries))
+	for i, e := range imageSet.Entries {
+		go func(i int, e images.Entry) {
+			defer wg.Done()
+			ref, err := e.Reference()
+			if err != nil {
+				log.Errorf("parse %s: %v.", e, err)
+				mu.Lock()
+				failed = append(failed, &client.Errno{Code: client.BadRequestErr.Code, Message: err.Error()})
+				mu.Unlock()
+				return
+			}
+			digest, status := resolveDigest(ctx, ref)
+			log.Debugf("resolve %s, digest: %s, status: %d, %s.", ref, digest, status.Code, status.Message)
+			if status.Code != client.OK.Code {
+				log.Errorf("resolve %s: %s.", ref, status.Message)
+				mu.Lock()
+				failed = append(failed, status)
+				mu.Unlock()
+				return
+			}
+			lf.Images[i] = images.LockedImage{Image: e.Image, Reference: lockReference(ref), Digest: digest}
+		}(i, e)
+	}
+	wg.Wait()
+	return lf, failed
+}
+
+// resolveDigest returns the manifest digest of the tag of the reference, or the
+// digest of the reference if it has no tag.
+func resolveDigest(ctx context.Context, ref images.Reference) (string, *client.Errno) {
+	if ref.Tag == "" {
+		return ref.Digest, client.OK
+	}
+	cli, err := registryClient(ctx, ref.Domain)
+	if err != nil {
+		return "", &client.Errno{Code: client.InternalServerErr.Code, Message: err.Error()}
+	}
+	digest, status := cli.HeadManifest(ctx, ref.Path, ref.Tag)
+	if status.Code == client.OK.Code && ref.Digest != "" && digest != ref.Digest {
+		return digest, &client.Errno{Code: client.BadRequestErr.Code, Message: fmt.Sprintf("tag %s is %s, but it is pinned to %s", ref.Tag, digest, ref.Digest)}
+	}
+	return digest, status
+}
+
+// lockReference returns the reference without the digest, it is the key of
+// the image in the lock file.
+func lockReference(ref images.Reference) string {
+	ref.Digest = ""
+	return ref.String()
+}
+
+// checkLockFile checks the image set against the lock file and returns the
+// locked digests keyed by the references. It fails if the images of the image
+// set are changed, or a tag is moved to another digest since the lock file is
+// generated.
+func checkLockFile(ctx context.Context, imageSet *images.ImageSet, file string) (map[string]string, error) {
+	lf, err := images.ReadLockFile(file)
+	if err != nil {
+		return nil, err
+	}
+	digests := lf.Digests()
+	var drifts []string
+	refs := make(map[string]images.Reference)
+	for _, e := range imageSet.Entries {
+		ref, err := e.Reference()
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %v", e, err)
+		}
+		key := lockReference(ref)
+		d, ok := digests[key]
+		if !ok {
+			drifts = append(drifts, fmt.Sprintf("%s is not in the lock file", key))
+			continue
+		}
+		if ref.Digest != "" && ref.Digest != d {
+			drifts = append(drifts, fmt.Sprintf("%s is pinned to %s, but it is locked to %s", key, ref.Digest, d))
+			continue
+		}
+		refs[key] = ref
+	}
+	for _, i := range lf.Images {
+		if _, ok := refs[i.Reference]; !ok {
+			drifts = append(drifts, fmt.Sprintf("%s is not in the image set", i.Reference))
+		}
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var rejected *client.Errno
+	for key, ref := range refs {
+		if ref.Tag == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(key string, ref images.Reference) {
+			defer wg.Done()
+			ref.Digest = ""
+			digest, status := resolveDigest(ctx, ref)
+			mu.Lock()
+			defer mu.Unlock()
+			if status.Code != client.OK.Code {
+				if isAuthStatus(status) {
+					rejected = status
+				}
+				drifts = append(drifts, fmt.Sprintf("resolve %s: %s", key, status.Message))
+			} else if digest != digests[key] {
+				drifts = append(drifts, fmt.Sprintf("%s is moved from %s to %s", key, digests[key], digest))
+			}
+		}(key, ref)
+	}
+	wg.Wait()
+
+	if len(drifts) > 0 {
+		for _, d := range drifts {
+			log.Errorf("drift: %s.", d)
+		}
+		if rejected != nil {
+			return nil, &client.Errno{Code: rejected.Code, Message: fmt.Sprintf("resolve the images of %s: %s", file, rejected.Message)}
+		}
+		return nil, fmt.Errorf("the image set drifts from %s with %d difference(s), run '%s %s' to update it", file, len(drifts), _defaultRootCommand, _defaultLockCommand)
+	}
+	return digests, nil
+}
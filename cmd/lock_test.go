@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+	"github.com/shipengqi/lighting-i/pkg/images"
+)
+
+func TestRunLock(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	digest := r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("base layer"))
+	dir, err := ioutil.TempDir("", "lighting-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	Conf.Registry, Conf.User, Conf.Password = r.URL, "", ""
+	lockConfig.ImagesSet = filepath.Join(dir, "image_set.yaml")
+	lockConfig.Output = images.LockFileName(lockConfig.ImagesSet)
+	data := []byte("org_name: shipengqi\nimages:\n  - apiserver:v1.0.0\n")
+	if err = ioutil.WriteFile(lockConfig.ImagesSet, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Lock the image set", func(t *testing.T) {
+		if code := runLock(context.Background()); code != _exitSuccess {
+			t.Fatalf("Wanted %d, got %d", _exitSuccess, code)
+		}
+		lf, err := images.ReadLockFile(lockConfig.Output)
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if len(lf.Images) != 1 || lf.Images[0].Digest != digest {
+			t.Fatalf("Wanted digest %s, got %v", digest, lf.Images)
+		}
+	})
+
+	t.Run("Fail on the missing image", func(t *testing.T) {
+		data := []byte("org_name: shipengqi\nimages:\n  - apiserver:v2.0.0\n")
+		if err = ioutil.WriteFile(lockConfig.ImagesSet, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if code := runLock(context.Background()); code == _exitSuccess {
+			t.Fatalf("Wanted failure, got %d", code)
+		}
+	})
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/server"
+	"github.com/shipengqi/lighting-i/pkg/log"
+	"github.com/shipengqi/lighting-i/pkg/utils"
+)
+
+type ServeConfig struct {
+	Dir      string
+	Listen   string
+	TLSCert  string
+	TLSKey   string
+	User     string
+	Password string
+	LogDir   string
+}
+
+var serveConfig ServeConfig
+
+func addServeFlags(flagSet *pflag.FlagSet) {
+	flagSet.StringVarP(&serveConfig.Dir, "dir", "d", "", "The download directory to serve, or its images.download.manifest.")
+	flagSet.StringVarP(&serveConfig.Listen, "listen", "l", ":5000", "The address to listen on.")
+	flagSet.StringVar(&serveConfig.TLSCert, "tls-cert", "", "TLS certificate file path, serve HTTPS if it is set with --tls-key.")
+	flagSet.StringVar(&serveConfig.TLSKey, "tls-key", "", "TLS key file path.")
+	flagSet.StringVarP(&serveConfig.User, "user", "u", "", "If set, require the basic auth with the username.")
+	flagSet.StringVarP(&serveConfig.Password, "pass", "p", "", "The basic auth password.")
+	flagSet.StringVar(&serveConfig.LogDir, "log-dir", _defaultBaseDir, "Log directory path.")
+}
+
+func serveCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   _defaultServeCommand,
+		Short: "Serve a download directory as a read-only Docker registry.",
+		PreRun: func(cmd *cobra.Command, args []string) {
+			if serveConfig.Dir == "" {
+				fmt.Println("--dir is required.")
+				os.Exit(_exitInvalidInput)
+			}
+			if (serveConfig.TLSCert == "") != (serveConfig.TLSKey == "") {
+				fmt.Println("--tls-cert and --tls-key must be set together.")
+				os.Exit(_exitInvalidInput)
+			}
+			if (serveConfig.User == "") != (serveConfig.Password == "") {
+				fmt.Println("--user and --pass must be set together.")
+				os.Exit(_exitInvalidInput)
+			}
+			if err := os.MkdirAll(serveConfig.LogDir, 0755); err != nil {
+				fmt.Printf("mkdir %v\n", err)
+				os.Exit(_exitFailure)
+			}
+			LogFilePath = filepath.Join(serveConfig.LogDir, _defaultServeLog)
+			log.Init(LogFilePath)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			imgs, err := loadServeImages(serveConfig.Dir)
+			if err != nil {
+				log.Errorf("load %v.", err)
+				os.Exit(_exitInvalidInput)
+			}
+			registry := server.New(imgs)
+			if serveConfig.User != "" {
+				registry.SetBasicAuth(serveConfig.User, serveConfig.Password)
+			}
+			srv := &http.Server{Addr: serveConfig.Listen, Handler: logRequests(registry)}
+
+			quit := make(chan os.Signal, 1)
+			signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+			go func() {
+				<-quit
+				log.Info("Shutting down ...")
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				_ = srv.Shutdown(ctx)
+			}()
+
+			log.Infof("Serving %d image(s) of %s on %s ...", len(imgs), serveConfig.Dir, serveConfig.Listen)
+			if serveConfig.TLSCert != "" {
+				err = srv.ListenAndServeTLS(serveConfig.TLSCert, serveConfig.TLSKey)
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != nil && err != http.ErrServerClosed {
+				log.Errorf("serve %v.", err)
+				os.Exit(_exitFailure)
+			}
+		},
+	}
+	cmd.Flags().SortFlags = false
+	addServeFlags(cmd.Flags())
+	return cmd
+}
+
+// loadServeImages returns the images of the download directory with the paths
+// of their blobs, the blobs of the base directories are included. The images
+// with missing blobs are skipped.
+func loadServeImages(dir string) ([]server.Image, error) {
+	file := dir
+	if utils.IsDir(dir) {
+		file = filepath.Join(dir, _defaultDownloadManifest)
+	}
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	dms, err := getImagesDownloadManifest(file)
+	if err != nil {
+		return nil, err
+	}
+	var imgs []server.Image
+	for _, m := range dms {
+		name := fmt.Sprintf("%s:%s", m.Image.Name, m.Image.Tag)
+		manifest := resolveBlobTarget(dir, m.Manifest.Target)
+		if m.Manifest.Digest == "" || manifest == "" {
+			log.Warnf("The manifest of %s is not found, skipped.", name)
+			continue
+		}
+		image := server.Image{Name: m.Image.Name, Tag: m.Image.Tag, Digest: m.Manifest.Digest, Manifest: manifest,
+			Blobs: make(map[string]string)}
+		content, err := ioutil.ReadFile(manifest)
+		if err != nil {
+			log.Warnf("read the manifest of %s %v, skipped.", name, err)
+			continue
+		}
+		image.MediaType = manifestMediaType(content)
+		complete := true
+		for _, l := range append([]LayerResponse{m.Config}, m.Layers...) {
+			target := resolveBlobTarget(dir, l.Target)
+			if target == "" {
+				log.Warnf("The blob %s of %s is not found, skipped.", l.Digest, name)
+				complete = false
+				break
+			}
+			image.Blobs[l.Digest] = target
+		}
+		if complete {
+			imgs = append(imgs, image)
+		}
+	}
+	return imgs, nil
+}
+
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("%s %s %s", r.RemoteAddr, r.Method, r.URL)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,302 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/images"
+	"github.com/shipengqi/lighting-i/pkg/log"
+	"github.com/shipengqi/lighting-i/pkg/progress"
+	"github.com/shipengqi/lighting-i/pkg/utils"
+)
+
+type SyncConfig struct {
+	From         string
+	FromUser     string
+	FromPassword string
+	To           string
+	ToUser       string
+	ToPassword   string
+	Auths        []string
+	RetryTimes   int
+	Progress     string
+	ImagesSet    string
+	Strict       bool
+	LogDir       string
+}
+
+// SyncResult is the result of the sync of an image.
+type SyncResult struct {
+	Image  client.ImageRepo
+	Status *client.Errno
+}
+
+var syncConfig SyncConfig
+var syncStats TransferStats
+
+// targetClient is the client of the target registry of 'sync'.
+var targetClient *client.Client
+
+func addSyncFlags(flagSet *pflag.FlagSet) {
+	flagSet.StringVar(&syncConfig.From, "from", "https://registry-1.docker.io", "The host of the source registry.")
+	flagSet.StringVar(&syncConfig.FromUser, "from-user", "", "Source registry account username.")
+	flagSet.StringVar(&syncConfig.FromPassword, "from-pass", "", "Source registry account password.")
+	flagSet.StringVar(&syncConfig.To, "to", "", "The host of the target registry.")
+	flagSet.StringVar(&syncConfig.ToUser, "to-user", "", "Target registry account username.")
+	flagSet.StringVar(&syncConfig.ToPassword, "to-pass", "", "Target registry account password.")
+	flagSet.StringArrayVar(&syncConfig.Auths, "auth", nil, "Credential of another source registry in the image set, in the form of <host>=<username>:<password>, can be repeated.")
+	flagSet.StringVarP(&syncConfig.ImagesSet, "image-set", "i", _defaultImageSet, "Images set file path.")
+	flagSet.BoolVar(&syncConfig.Strict, "strict", false, "If true, fail on the warnings of the image set too, e.g. the duplicate images.")
+	flagSet.IntVarP(&syncConfig.RetryTimes, "retry", "t", 0, "The retry times when the request fails.")
+	flagSet.StringVar(&syncConfig.Progress, "progress", progress.ModeAuto, "Progress output: auto, bar, plain, json or none. 'auto' prints plain lines if stdout is not a terminal.")
+	flagSet.StringVar(&syncConfig.LogDir, "log-dir", _defaultBaseDir, "Log directory path.")
+}
+
+func syncCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   _defaultSyncCommand,
+		Short: "Copy the images of the image set from a registry to another registry, without writing them to disk.",
+		PreRun: func(cmd *cobra.Command, args []string) {
+			// Init Conf
+			Conf.RetryTimes = syncConfig.RetryTimes
+			Conf.Registry = syncConfig.From
+			Conf.User = syncConfig.FromUser
+			Conf.Password = syncConfig.FromPassword
+			Conf.Auths = syncConfig.Auths
+			if syncConfig.To == "" {
+				fmt.Println("--to is required.")
+				os.Exit(_exitInvalidInput)
+			}
+			if err := initProgress(syncConfig.Progress); err != nil {
+				fmt.Println(err)
+				os.Exit(_exitInvalidInput)
+			}
+			if err := os.MkdirAll(syncConfig.LogDir, 0755); err != nil {
+				fmt.Printf("mkdir %v\n", err)
+				os.Exit(_exitFailure)
+			}
+			LogFilePath = filepath.Join(syncConfig.LogDir, _defaultSyncLog)
+			log.Init(LogFilePath)
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			exitWith(runSync)
+		},
+	}
+	cmd.Flags().SortFlags = false
+	addSyncFlags(cmd.Flags())
+	return cmd
+}
+
+// runSync copies the images, it returns the exit code.
+func runSync(ctx context.Context) int {
+	if !checkImageSet(syncConfig.ImagesSet) {
+		log.Errorf("%s is not exists.", syncConfig.ImagesSet)
+		return _exitInvalidInput
+	}
+	imageSet, err := images.GetImagesFromSet(syncConfig.ImagesSet)
+	if err != nil {
+		log.Errorf("get images %v.", err)
+		return _exitInvalidInput
+	}
+	if !checkImageSetWarnings(imageSet, syncConfig.Strict) {
+		return _exitInvalidInput
+	}
+	if err = initClient(ctx); err != nil {
+		log.Errorf("init client %v.", err)
+		return errorExitCode(err)
+	}
+	targetClient, err = newClient(ctx, syncConfig.To, syncConfig.ToUser, syncConfig.ToPassword)
+	if err != nil {
+		log.Errorf("init target client %v.", err)
+		return errorExitCode(err)
+	}
+	imageSet.Entries, err = resolveTagPatterns(ctx, imageSet.Entries)
+	if err != nil {
+		log.Errorf("resolve tag patterns %v.", err)
+		return errorExitCode(err)
+	}
+
+	log.Infof("Starting the sync from %s to %s ...", syncConfig.From, syncConfig.To)
+	allManifest := fetchAllManifest(ctx, imageSet)
+	if ctx.Err() != nil {
+		log.Warnf("The sync is interrupted.")
+		return _exitInterrupted
+	}
+	mcr := checkFetchManifestResult(allManifest)
+	if len(mcr.Failed) > 0 {
+		var statuses []*client.Errno
+		for _, m := range mcr.Failed {
+			log.Errorf("fetch manifest of %s:%s, %s", m.Manifest.Image.Name, m.Manifest.Image.Tag, m.Status.Message)
+			statuses = append(statuses, m.Status)
+		}
+		log.Errorf("Fetch images manifest with errors.")
+		log.Infof("You can refer to %s for more detail.", LogFilePath)
+		return statusExitCode(_exitFailure, statuses...)
+	}
+
+	results := syncImages(ctx, allManifest)
+	if ctx.Err() != nil {
+		log.Warnf("The sync is interrupted, the images without a pushed manifest are not visible in %s.", syncConfig.To)
+		return _exitInterrupted
+	}
+	var failed []*client.Errno
+	for _, r := range results {
+		if r.Status.Code != client.OK.Code {
+			log.Errorf("sync %s:%s, %s", r.Image.Name, r.Image.Tag, r.Status.Message)
+			failed = append(failed, r.Status)
+		}
+	}
+	log.Infof("Transferred: %s, deduplicated: %s, skipped: %s.", utils.HumanSize(syncStats.Transferred),
+		utils.HumanSize(syncStats.Deduplicated), utils.HumanSize(syncStats.Skipped))
+	if len(failed) > 0 {
+		log.Errorf("Sync images with %d error(s).", len(failed))
+		log.Infof("You can refer to %s for more detail.", LogFilePath)
+		return statusExitCode(_exitPartial, failed...)
+	}
+	log.Infof("Successfully synced %d image(s).", len(results))
+	return _exitSuccess
+}
+
+// syncImages copies the images concurrently, the blobs shared by the images of
+// a repository are copied once.
+func syncImages(ctx context.Context, manifests []ManifestResponse) []SyncResult {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var results []SyncResult
+	var blobs sync.Map
+	progress.Start()
+	totalBar := addTotalProgressBar(syncTotalSize(manifests))
+	wg.Add(len(manifests))
+	for _, m := range manifests {
+		bar := addProgressBar(manifestSize(m.Manifest), m.Manifest.Image)
+		go func(m *client.Manifest, bar *progress.Bar) {
+			defer wg.Done()
+			status := syncImage(ctx, m, &blobs, bar, totalBar)
+			mu.Lock()
+			results = append(results, SyncResult{Image: m.Image, Status: status})
+			mu.Unlock()
+		}(m.Manifest, bar)
+	}
+	wg.Wait()
+	progress.Stop()
+	return results
+}
+
+// syncTotalSize returns the bytes of the blobs to copy, a blob shared by the
+// images of a repository is counted once, as it is copied once by syncImage. A
+// blob shared by the repositories is copied to each of them.
+func syncTotalSize(manifests []ManifestResponse) int64 {
+	var total int64
+	seen := make(map[string]bool)
+	for _, m := range manifests {
+		for _, l := range append([]client.Layer{m.Manifest.Config}, m.Manifest.Layers...) {
+			key := m.Manifest.Image.Name + "@" + l.Digest
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			total += l.Size
+		}
+	}
+	return total
+}
+
+// syncImage copies the config and the layers of the image, then pushes the
+// manifest, so that the image is not visible in the target registry until all
+// of its blobs are copied.
+func syncImage(ctx context.Context, m *client.Manifest, blobs *sync.Map, bar, totalBar *progress.Bar) *client.Errno {
+	for _, l := range append([]client.Layer{m.Config}, m.Layers...) {
+		v, loaded := blobs.LoadOrStore(m.Image.Name+"@"+l.Digest, &RequiredLayer{Layer: l, Image: m.Image})
+		required := v.(*RequiredLayer)
+		if loaded {
+			syncStats.AddDeduplicated(l.Size)
+		}
+		required.once.Do(func() {
+			required.status = syncBlob(ctx, m.Image, l, bar, totalBar)
+		})
+		if loaded {
+			bar.Add(l.Size)
+		}
+		if required.status.Code != client.OK.Code {
+			return &client.Errno{Code: required.status.Code, Message: fmt.Sprintf("blob %s: %s", l.Digest, required.status.Message)}
+		}
+	}
+
+	reference := m.Image.Tag
+	if reference == "" {
+		reference = m.Digest
+	}
+	mediaType := m.MediaType
+	if mediaType == "" {
+		mediaType = client.MediaTypeManifest
+	}
+	digest, status := targetClient.PushManifest(ctx, m.Image.Name, reference, mediaType, m.Raw)
+	if status.Code != client.OK.Code {
+		return &client.Errno{Code: status.Code, Message: fmt.Sprintf("push manifest: %s", status.Message)}
+	}
+	if digest != "" && digest != m.Digest {
+		return &client.Errno{Code: client.BadRequestErr.Code, Message: fmt.Sprintf("manifest digest changed, want %s, got %s", m.Digest, digest)}
+	}
+	return client.OK
+}
+
+// syncBlob streams a blob from the source registry to the target registry, it
+// is skipped if the target has it. The stream cannot be replayed, so a failed
+// copy is retried from the start.
+func syncBlob(ctx context.Context, image client.ImageRepo, l client.Layer, bar, totalBar *progress.Bar) *client.Errno {
+	name := image.Name
+	if status := targetClient.CheckBlobs(ctx, name, l.Digest); status.Code == client.OK.Code {
+		syncStats.AddSkipped(l.Size)
+		totalBar.Add(l.Size)
+		bar.Add(l.Size)
+		return status
+	}
+	source, err := registryClient(ctx, image.Registry)
+	if err != nil {
+		return &client.Errno{Code: client.InternalServerErr.Code, Message: err.Error()}
+	}
+	var status *client.Errno
+	for i := 0; i <= syncConfig.RetryTimes; i++ {
+		var copied int64
+		status = copyBlob(ctx, source, name, l, func(n int64) {
+			copied += n
+			bar.Add(n)
+			totalBar.Add(n)
+		})
+		if status.Code == client.OK.Code {
+			syncStats.AddTransferred(copied)
+			return status
+		}
+		// roll back the progress of the failed copy
+		bar.Add(-copied)
+		totalBar.Add(-copied)
+		if status.Code == client.CanceledErr.Code {
+			return status
+		}
+		log.Debugf("copy blob %s of %s, attempt %d, %s.", l.Digest, name, i+1, status.Message)
+	}
+	return status
+}
+
+func copyBlob(ctx context.Context, source *client.Client, name string, l client.Layer, progressFunc client.ProgressFunc) *client.Errno {
+	body, size, status := source.OpenBlob(ctx, name, l.Digest, progressFunc)
+	if status.Code != client.OK.Code {
+		return status
+	}
+	defer body.Close()
+	if size < 0 {
+		size = l.Size
+	}
+	status = targetClient.StartUpload(ctx, name)
+	if status.Code != client.OK.Code {
+		return status
+	}
+	return targetClient.PushBlobStream(ctx, name, l.Digest, status.Message, body, size)
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+	"github.com/shipengqi/lighting-i/pkg/images"
+	"github.com/shipengqi/lighting-i/pkg/progress"
+)
+
+// setupSync points the source client to the registry src and the target
+// client to the registry dst.
+func setupSync(t *testing.T, src, dst *registrytest.Registry) {
+	if err := progress.SetMode(progress.ModeNone); err != nil {
+		t.Fatal(err)
+	}
+	Conf.Registry, Conf.User, Conf.Password = src.URL, "admin", "secret"
+	if err := initClient(context.Background()); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	var err error
+	if targetClient, err = newClient(context.Background(), dst.URL, "admin", "secret"); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+}
+
+// syncImageSet syncs the images, it fails if the manifest of any of them
+// cannot be fetched.
+func syncImageSet(t *testing.T, entries ...string) []SyncResult {
+	allManifest, _ := fetchImageSet(t, entries...)
+	return syncImages(context.Background(), allManifest)
+}
+
+func TestSync(t *testing.T) {
+	src := registrytest.New(registrytest.WithBearerAuth("admin", "secret"))
+	defer src.Close()
+	dst := registrytest.New(registrytest.WithBasicAuth("admin", "secret"))
+	defer dst.Close()
+	layers := [][]byte{[]byte("base layer"), []byte("app layer")}
+	digest := src.AddImage("shipengqi/apiserver", "v1.0.0", layers...)
+	setupSync(t, src, dst)
+
+	t.Run("Sync an image", func(t *testing.T) {
+		syncStats = TransferStats{}
+		results := syncImageSet(t, "shipengqi/apiserver:v1.0.0")
+		if len(results) != 1 || results[0].Status.Code != client.OK.Code {
+			t.Fatalf("Wanted 1 synced image, got %v", results)
+		}
+		content, ok := dst.Manifest("shipengqi/apiserver", "v1.0.0")
+		if !ok || registrytest.Digest(content) != digest {
+			t.Fatalf("Wanted manifest %s, got %v", digest, ok)
+		}
+		for _, l := range layers {
+			if !dst.HasBlob("shipengqi/apiserver", registrytest.Digest(l)) {
+				t.Fatalf("Wanted blob %s, got none", registrytest.Digest(l))
+			}
+		}
+		if syncStats.Transferred == 0 || syncStats.Skipped != 0 {
+			t.Fatalf("Wanted transferred blobs, got %+v", syncStats)
+		}
+	})
+
+	t.Run("Skip the existing blobs", func(t *testing.T) {
+		syncStats = TransferStats{}
+		results := syncImageSet(t, "shipengqi/apiserver:v1.0.0")
+		if len(results) != 1 || results[0].Status.Code != client.OK.Code {
+			t.Fatalf("Wanted 1 synced image, got %v", results)
+		}
+		if syncStats.Transferred != 0 || syncStats.Skipped == 0 {
+			t.Fatalf("Wanted skipped blobs, got %+v", syncStats)
+		}
+	})
+
+	t.Run("Fail to push the manifest", func(t *testing.T) {
+		dst.AddFault(registrytest.Fault{Method: http.MethodPut, Path: "/manifests/", Status: http.StatusInternalServerError, Times: 1})
+		results := syncImageSet(t, "shipengqi/apiserver:v1.0.0")
+		if len(results) != 1 || results[0].Status.Code != http.StatusInternalServerError {
+			t.Fatalf("Wanted %d, got %v", http.StatusInternalServerError, results)
+		}
+	})
+}
+
+func TestSyncTotalSize(t *testing.T) {
+	src := registrytest.New()
+	defer src.Close()
+	dst := registrytest.New()
+	defer dst.Close()
+	layers := [][]byte{[]byte("base layer"), []byte("app layer")}
+	src.AddImage("shipengqi/apiserver", "v1.0.0", layers...)
+	src.AddImage("shipengqi/apiserver", "v1.0.1", layers...)
+	src.AddImage("shipengqi/controller", "v1.0.0", layers...)
+	setupSync(t, src, dst)
+
+	allManifest, mcr := fetchImageSet(t, "shipengqi/apiserver:v1.0.0", "shipengqi/apiserver:v1.0.1", "shipengqi/controller:v1.0.0")
+	// the layers are copied once to each of the repositories
+	var want int64
+	for _, m := range allManifest {
+		want += m.Manifest.Config.Size
+	}
+	for _, l := range layers {
+		want += 2 * int64(len(l))
+	}
+	if got := syncTotalSize(allManifest); got != want {
+		t.Fatalf("Wanted %d, got %d", want, got)
+	}
+	if mcr.TotalSize >= want {
+		t.Fatalf("Wanted the global total less than %d, got %d", want, mcr.TotalSize)
+	}
+}
+
+func TestSyncStrictImageSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lighting-sync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	syncConfig.ImagesSet = filepath.Join(dir, "image_set.yaml")
+	data := []byte("org_name: shipengqi\nimages:\n  - apiserver:v1.0.0\n  - apiserver:v1.0.0\n")
+	if err = ioutil.WriteFile(syncConfig.ImagesSet, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { syncConfig.Strict = false }()
+
+	t.Run("Fail on the duplicate images", func(t *testing.T) {
+		syncConfig.Strict = true
+		if code := runSync(context.Background()); code != _exitInvalidInput {
+			t.Fatalf("Wanted %d, got %d", _exitInvalidInput, code)
+		}
+	})
+
+	t.Run("Ignore the duplicate images", func(t *testing.T) {
+		imageSet, err := images.GetImagesFromSet(syncConfig.ImagesSet)
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if !checkImageSetWarnings(imageSet, false) || len(imageSet.Entries) != 1 {
+			t.Fatalf("Wanted 1 image, got %v", imageSet.Entries)
+		}
+	})
+}
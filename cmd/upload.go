@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,13 +10,13 @@ import (
 	"sync"
 	"time"
 
-	"github.com/gosuri/uiprogress"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
 
 	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
 	"github.com/shipengqi/lighting-i/pkg/filelock"
 	"github.com/shipengqi/lighting-i/pkg/log"
+	"github.com/shipengqi/lighting-i/pkg/progress"
 	"github.com/shipengqi/lighting-i/pkg/utils"
 )
 
@@ -26,16 +27,25 @@ type UploadConfig struct {
 	RetryTimes  int
 	Registry    string
 	Force       bool
+	LockScope   string
+	Wait        time.Duration
+	Progress    string
 	Org         string
 	Overwrite   bool
 }
 
 type UploadManifest struct {
-	Layers []LayerResponse
-	Image  client.ImageRepo
+	Manifest LayerResponse
+	Layers   []LayerResponse
+	Image    client.ImageRepo
 }
 
 var uploadConfig UploadConfig
+var uploadStats TransferStats
+
+// uploadLockFile is the process lock file of the scope of '--lock-scope', it
+// is empty for the dir scope.
+var uploadLockFile string
 
 func addUploadFlags(flagSet *pflag.FlagSet) {
 	flagSet.StringVarP(&uploadConfig.Registry, "registry", "r", "https://registry-1.docker.io", "The host of the registry.")
@@ -44,7 +54,12 @@ func addUploadFlags(flagSet *pflag.FlagSet) {
 	flagSet.StringVarP(&uploadConfig.User, "user", "u", "", "Registry account username.")
 	flagSet.StringVarP(&uploadConfig.Password, "pass", "p", "", "Registry account password.")
 	flagSet.IntVarP(&uploadConfig.RetryTimes, "retry", "t", 0, "The retry times when the image download fails.")
-	flagSet.BoolVarP(&uploadConfig.Force, "force", "f", false, "If true, ignore the process lock.")
+	flagSet.StringVar(&uploadConfig.LockScope, "lock-scope", _lockScopeGlobal,
+		"Scope of the process lock: global (one upload on the host) or dir (one upload per --dir).")
+	flagSet.BoolVarP(&uploadConfig.Force, "force", "f", false, "Removed, use --lock-scope instead.")
+	_ = flagSet.MarkHidden("force")
+	flagSet.DurationVar(&uploadConfig.Wait, "wait", 0, "Wait up to this duration for the running instance to release the process lock, e.g. 10m. Default is to fail at once.")
+	flagSet.StringVar(&uploadConfig.Progress, "progress", progress.ModeAuto, "Progress output: auto, bar, plain, json or none. 'auto' prints plain lines if stdout is not a terminal.")
 	flagSet.BoolVarP(&uploadConfig.Overwrite, "overwrite", "w", false, "If true, overwrite the existing images on the registry.")
 }
 
@@ -59,80 +74,63 @@ func uploadCommand() *cobra.Command {
 			Conf.Registry = uploadConfig.Registry
 			Conf.User = uploadConfig.User
 			Conf.Password = uploadConfig.Password
+			if err := initProgress(uploadConfig.Progress); err != nil {
+				fmt.Println(err)
+				os.Exit(_exitInvalidInput)
+			}
 
 			if uploadConfig.Dir == "" {
 				fmt.Println("Images tar directory path is required, pleased use '--dir' or '-d'.")
-				os.Exit(1)
+				os.Exit(_exitInvalidInput)
 			}
 
 			if !utils.PathIsExist(uploadConfig.Dir) {
 				fmt.Println("Images tar directory path is invalid.")
-				os.Exit(1)
+				os.Exit(_exitInvalidInput)
 			}
 
 			if !utils.PathIsExist(filepath.Join(uploadConfig.Dir, _defaultDownloadManifest)) {
 				fmt.Println("'images.download.manifest' file is invalid.")
-				os.Exit(1)
+				os.Exit(_exitInvalidInput)
+			}
+
+			if uploadConfig.Force {
+				fmt.Println(forceRemoved)
+				os.Exit(_exitInvalidInput)
+			}
+			lockFile, err := processLockFile(uploadConfig.LockScope, _defaultUploadLock, uploadConfig.Dir)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(_exitInvalidInput)
 			}
 
 			ImageDateFolderPath = uploadConfig.Dir
 			LogFilePath = filepath.Join(ImageDateFolderPath, _defaultUploadLog)
 			log.Init(LogFilePath)
 
-			if uploadConfig.Force {
-				return
+			// the lock of the dir scope is the lock of the images directory
+			if uploadConfig.LockScope != _lockScopeDir {
+				log.Debugf("Using process lock: %s", lockFile)
+				if err := acquireLock(lockFile, uploadConfig.Wait); err != nil {
+					log.Errorf("lock %v.", err)
+					log.Errorf("Only one instance is allowed at a time in the %s scope, use '--wait' to wait for the running instance.", uploadConfig.LockScope)
+					os.Exit(lockExitCode(err))
+				}
+				uploadLockFile = lockFile
 			}
 
-			if err := filelock.Lock(_defaultUploadLockFile); err != nil {
-				log.Error("One instance is already running and only one instance is allowed at a time.")
-				log.Error("Check to see if another instance is running.")
-				log.Fatalf("If the instance stops running, delete %s file.\n", _defaultUploadLockFile)
+			// Lock the images directory, so that it is not deleted by 'gc' while uploading
+			if err := acquireLock(filepath.Join(ImageDateFolderPath, _defaultUploadLock), uploadConfig.Wait); err != nil {
+				if uploadLockFile != "" {
+					_ = filelock.UnLock(uploadLockFile)
+				}
+				log.Errorf("lock %v.", err)
+				log.Error("Another instance is uploading the images of this directory.")
+				os.Exit(lockExitCode(err))
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			defer func() {
-				log.Infof("You can refer to %s for more detail.", LogFilePath)
-				filelock.UnLock(_defaultUploadLockFile)
-			}()
-
-			err := initClient()
-			if err != nil {
-				log.Errorf("init client %v.", err)
-				return
-			}
-
-			dm, err := getImagesDownloadManifest(filepath.Join(uploadConfig.Dir, _defaultDownloadManifest))
-			if err != nil {
-				log.Errorf("get manifest %v.", err)
-				return
-			}
-			log.Debug("read download manifest", dm)
-			log.Infof("Starting the upload the images to %s under %s ...", uploadConfig.Org, ImageDateFolderPath)
-
-			completedc := make(chan int, 1)
-			go uploadImages(dm, completedc)
-
-			exitc := make(chan int, 1)
-			go handleSignals(exitc)
-			for {
-				select {
-				case failed := <-completedc:
-					if failed < 1 {
-						log.Infof("Successfully upload the images to %s under %s .", uploadConfig.Org, ImageDateFolderPath)
-					} else {
-						log.Errorf("Upload images with %d error(s).", failed)
-					}
-
-					log.Infof("You can refer to %s for more detail.", LogFilePath)
-					filelock.UnLock(_defaultUploadLockFile)
-					os.Exit(0)
-				case code := <-exitc:
-					filelock.UnLock(_defaultUploadLockFile)
-					os.Exit(code)
-				default:
-					time.Sleep(10 * time.Millisecond)
-				}
-			}
+			exitWith(runUpload)
 		},
 	}
 	cmd.Flags().SortFlags = false
@@ -140,31 +138,85 @@ func uploadCommand() *cobra.Command {
 	return cmd
 }
 
+// runUpload uploads the images, it returns the exit code. If ctx is canceled,
+// the in-flight uploads are aborted, the manifests of the images whose blobs
+// are not all uploaded are not pushed.
+func runUpload(ctx context.Context) int {
+	defer func() {
+		log.Infof("You can refer to %s for more detail.", LogFilePath)
+		unlockUpload()
+	}()
+
+	err := initClient(ctx)
+	if err != nil {
+		log.Errorf("init client %v.", err)
+		return errorExitCode(err)
+	}
+
+	dm, err := getImagesDownloadManifest(filepath.Join(uploadConfig.Dir, _defaultDownloadManifest))
+	if err != nil {
+		log.Errorf("get manifest %v.", err)
+		return _exitInvalidInput
+	}
+	log.Debug("read download manifest", dm)
+	log.Infof("Starting the upload the images to %s under %s ...", uploadConfig.Org, ImageDateFolderPath)
+
+	failed := uploadImages(ctx, dm)
+	if ctx.Err() != nil {
+		log.Warnf("The upload is interrupted, the uploaded images are recorded in %s.", filepath.Join(ImageDateFolderPath, _defaultUploadManifest))
+		return _exitInterrupted
+	}
+	if len(failed) > 0 {
+		log.Errorf("Upload images with %d error(s).", len(failed))
+		return statusExitCode(_exitPartial, failed...)
+	}
+	log.Infof("Successfully upload the images to %s under %s .", uploadConfig.Org, ImageDateFolderPath)
+	return _exitSuccess
+}
+
+func unlockUpload() {
+	_ = filelock.UnLock(filepath.Join(ImageDateFolderPath, _defaultUploadLock))
+	if uploadLockFile != "" {
+		_ = filelock.UnLock(uploadLockFile)
+	}
+}
+
 func getImagesDownloadManifest(file string) ([]DownloadManifest, error) {
 	var dm []DownloadManifest
 	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		return nil, fmt.Errorf("read manifest: %v", err)
 	}
-	err = json.Unmarshal(data, dm)
+	err = json.Unmarshal(data, &dm)
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal: %v", err)
 	}
 	return dm, nil
 }
 
-func uploadImages(dm []DownloadManifest, completedc chan int) {
+// uploadImages uploads the images and writes the upload manifest, it returns
+// the statuses of the failed blobs and manifests.
+func uploadImages(ctx context.Context, dm []DownloadManifest) []*client.Errno {
 	var wg sync.WaitGroup
-	var ums []*UploadManifest
+	ums := make([]*UploadManifest, len(dm))
 	log.Debugf("upload images with %d goroutines.", len(dm))
 	wg.Add(len(dm))
-	uiprogress.Start()
-	for _, m := range dm {
-		bar := addProgressBar(len(m.Layers), m.Image)
-		go func(m DownloadManifest, bar2 *uiprogress.Bar) {
+	progress.Start()
+	var total int64
+	sizes := make([]int64, len(dm))
+	for i, m := range dm {
+		for _, l := range imageBlobs(m) {
+			sizes[i] += blobSize(l)
+		}
+		total += sizes[i]
+	}
+	totalBar := addTotalProgressBar(total)
+	for i, m := range dm {
+		bar := addProgressBar(sizes[i], m.Image)
+		go func(i int, m DownloadManifest, bar2 *progress.Bar) {
 			defer wg.Done()
-			uploadLayersOfImage(m, bar2)
-		}(m, bar)
+			ums[i] = uploadLayersOfImage(ctx, m, bar2, totalBar)
+		}(i, m, bar)
 	}
 	wg.Wait()
 	log.Debug("upload images completed.")
@@ -172,77 +224,167 @@ func uploadImages(dm []DownloadManifest, completedc chan int) {
 	if err != nil {
 		log.Errorf("generate manifest %v.", err)
 	}
-	uiprogress.Stop()
-	failed := checkUploadBlobsResult(ums)
-	completedc <- failed
+	progress.Stop()
+	log.Infof("Transferred: %s, skipped: %s.", utils.HumanSize(uploadStats.Transferred), utils.HumanSize(uploadStats.Skipped))
+	return checkUploadBlobsResult(ums)
 }
 
-func uploadLayersOfImage(m DownloadManifest, bar *uiprogress.Bar) *UploadManifest {
+func uploadLayersOfImage(ctx context.Context, m DownloadManifest, bar, totalBar *progress.Bar) *UploadManifest {
 	var wg sync.WaitGroup
 	um := &UploadManifest{Image: m.Image}
-	if !uploadConfig.Overwrite && checkImagesTagIsExists(m.Image.Name, m.Image.Tag) {
-		_ = bar.Set(bar.Total)
-		return um
+	if !uploadConfig.Overwrite {
+		exists, status := checkImagesTagIsExists(ctx, m.Image)
+		if status != nil {
+			um.Manifest = LayerResponse{status, m.Manifest.Digest, m.Manifest.Target}
+			totalBar.Add(bar.Total)
+			bar.Add(bar.Total)
+			return um
+		}
+		if exists {
+			uploadStats.AddSkipped(bar.Total)
+			totalBar.Add(bar.Total)
+			bar.Add(bar.Total)
+			return um
+		}
 	}
-	for _, l := range m.Layers {
-		if checkImagesLayerIsExists(m.Image.Name, l.Digest) {
-			um.Layers = append(um.Layers, LayerResponse{client.OK, l.Digest,l.Target})
-			bar.Incr()
+	blobs := imageBlobs(m)
+	// the layers are in the order of the blobs of the image
+	um.Layers = make([]LayerResponse, len(blobs))
+	for i, l := range blobs {
+		size := blobSize(l)
+		if checkImagesLayerIsExists(ctx, m.Image.Name, l.Digest) {
+			um.Layers[i] = LayerResponse{client.OK, l.Digest, l.Target}
+			uploadStats.AddSkipped(size)
+			totalBar.Add(size)
+			bar.Add(size)
 			continue
 		}
 		wg.Add(1)
-		go func(l LayerResponse) {
+		go func(i int, l LayerResponse) {
 			defer wg.Done()
-			err := uploadBlobs(m.Image, l)
+			err := uploadBlobs(ctx, m.Image, l)
 			log.Debugf("upload blobs %s of %s, status: %d, %s.", l.Target, m.Image.Name, err.Code, err.Message)
-			um.Layers = append(um.Layers, LayerResponse{err, l.Digest, l.Target})
-			bar.Incr()
-		}(l)
+			um.Layers[i] = LayerResponse{err, l.Digest, l.Target}
+			if err.Code == client.OK.Code {
+				uploadStats.AddTransferred(size)
+			}
+			totalBar.Add(size)
+			bar.Add(size)
+		}(i, l)
 	}
 	wg.Wait()
+	for _, l := range um.Layers {
+		if l.Status.Code != client.OK.Code {
+			return um
+		}
+	}
+	if m.Manifest.Digest == "" {
+		log.Warnf("Warning: %s:%s has no manifest in %s, only the blobs are uploaded.", m.Image.Name, m.Image.Tag, _defaultDownloadManifest)
+		return um
+	}
+	err := pushImageManifest(ctx, m)
+	log.Debugf("push manifest %s of %s, status: %d, %s.", m.Manifest.Digest, m.Image.Name, err.Code, err.Message)
+	um.Manifest = LayerResponse{err, m.Manifest.Digest, m.Manifest.Target}
 	return um
 }
 
-func uploadBlobs(i client.ImageRepo, l LayerResponse) *client.Errno {
-	res := c.StartUpload(i.Name)
+// imageBlobs returns the config and the layers of the image.
+func imageBlobs(m DownloadManifest) []LayerResponse {
+	if m.Config.Digest == "" {
+		return m.Layers
+	}
+	return append([]LayerResponse{m.Config}, m.Layers...)
+}
+
+// pushImageManifest pushes the downloaded manifest content by the original
+// tag, or by the digest if the image has no tag. The content is not changed,
+// so the digest of the image is preserved.
+func pushImageManifest(ctx context.Context, m DownloadManifest) *client.Errno {
+	target := resolveBlobTarget(uploadConfig.Dir, m.Manifest.Target)
+	if target == "" {
+		return &client.Errno{Code: client.NotFoundErr.Code, Message: fmt.Sprintf("manifest %s is not found", m.Manifest.Digest)}
+	}
+	content, err := ioutil.ReadFile(target)
+	if err != nil {
+		return &client.Errno{Code: client.InternalServerErr.Code, Message: err.Error()}
+	}
+	reference := m.Image.Tag
+	if reference == "" {
+		reference = m.Manifest.Digest
+	}
+	digest, status := c.PushManifest(ctx, m.Image.Name, reference, manifestMediaType(content), content)
+	if status.Code != client.OK.Code {
+		return status
+	}
+	if digest != "" && digest != m.Manifest.Digest {
+		return &client.Errno{Code: client.BadRequestErr.Code, Message: fmt.Sprintf("manifest digest changed, want %s, got %s", m.Manifest.Digest, digest)}
+	}
+	return status
+}
+
+// blobSize returns the size of the downloaded blob, or 0 if it is not found.
+func blobSize(l LayerResponse) int64 {
+	fi, err := os.Stat(resolveBlobTarget(uploadConfig.Dir, l.Target))
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func uploadBlobs(ctx context.Context, i client.ImageRepo, l LayerResponse) *client.Errno {
+	target := resolveBlobTarget(uploadConfig.Dir, l.Target)
+	if target == "" {
+		return &client.Errno{Code: client.NotFoundErr.Code, Message: fmt.Sprintf("blob %s is not found", l.Digest)}
+	}
+	res := c.StartUpload(ctx, i.Name)
 	if res.Code != client.OK.Code {
 		return res
 	}
 	uuid := res.Message
-	res = c.PushBlobs(i.Name, l.Digest, uuid, l.Target)
+	res = c.PushBlobs(ctx, i.Name, l.Digest, uuid, target)
 	return res
 }
 
-func checkImagesTagIsExists(name, tag string) bool {
-	list, err := c.ListImageTags(name)
-	if err != nil {
-		return false
+// checkImagesTagIsExists checks the manifest of the tag (or the digest if the
+// image has no tag) with a HEAD request. The tag exists only if the registry
+// returns 200, a 404 means it does not exist, the other statuses are returned
+// as errors, e.g. a 5xx.
+func checkImagesTagIsExists(ctx context.Context, image client.ImageRepo) (bool, *client.Errno) {
+	ref := image.Tag
+	if ref == "" {
+		ref = image.Digest
 	}
-	for _, t := range list.Tags {
-		if t == tag {
-			return true
-		}
+	_, status := c.HeadManifest(ctx, image.Name, ref)
+	switch status.Code {
+	case client.OK.Code:
+		return true, nil
+	case client.NotFoundErr.Code:
+		return false, nil
 	}
-	return false
+	return false, status
 }
 
-func checkImagesLayerIsExists(name, digest string) bool {
-	err := c.CheckBlobs(name, digest)
+func checkImagesLayerIsExists(ctx context.Context, name, digest string) bool {
+	err := c.CheckBlobs(ctx, name, digest)
 	if err.Code == client.OK.Code {
 		return true
 	}
 	return false
 }
 
-func checkUploadBlobsResult(ums []*UploadManifest) int {
-	var failed int
+// checkUploadBlobsResult returns the statuses of the failed blobs and manifests.
+func checkUploadBlobsResult(ums []*UploadManifest) []*client.Errno {
+	var failed []*client.Errno
 	for _, m := range ums {
+		if m.Manifest.Status != nil && m.Manifest.Status.Code != client.OK.Code {
+			failed = append(failed, m.Manifest.Status)
+		}
 		if len(m.Layers) < 1 {
 			continue
 		}
 		for _, l := range m.Layers {
 			if l.Status.Code != client.OK.Code {
-				failed ++
+				failed = append(failed, l.Status)
 			}
 		}
 	}
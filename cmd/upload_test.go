@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/client"
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+)
+
+func TestUploadImages(t *testing.T) {
+	src := registrytest.New()
+	defer src.Close()
+	refs := addImages(src, 8)
+	dir := setupDownload(t, src)
+	defer os.RemoveAll(dir)
+	allManifest, mcr := fetchImageSet(t, refs...)
+	if failed := downloadImages(context.Background(), allManifest, mcr.Required); len(failed) != 0 {
+		t.Fatalf("Wanted no failed blobs, got %v", failed)
+	}
+	dm, err := getImagesDownloadManifest(filepath.Join(dir, _defaultDownloadManifest))
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+
+	dst := registrytest.New()
+	defer dst.Close()
+	Conf.Registry = dst.URL
+	if err := initClient(context.Background()); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	uploadConfig.Dir, uploadConfig.Overwrite = dir, true
+
+	t.Run("Upload images", func(t *testing.T) {
+		uploadStats = TransferStats{}
+		if failed := uploadImages(context.Background(), dm); len(failed) != 0 {
+			t.Fatalf("Wanted no failed blobs, got %v", failed)
+		}
+		for _, m := range allManifest {
+			content, ok := dst.Manifest(m.Manifest.Image.Name, m.Manifest.Image.Tag)
+			if !ok || registrytest.Digest(content) != m.Manifest.Digest {
+				t.Fatalf("Wanted manifest %s, got %v", m.Manifest.Digest, ok)
+			}
+		}
+		var ums []UploadManifest
+		data, err := ioutil.ReadFile(filepath.Join(dir, _defaultUploadManifest))
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if err = json.Unmarshal(data, &ums); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if len(ums) != len(dm) {
+			t.Fatalf("Wanted %d images, got %d", len(dm), len(ums))
+		}
+		for i, um := range ums {
+			if um.Image.Name != dm[i].Image.Name || um.Manifest.Status.Code != client.OK.Code {
+				t.Fatalf("Wanted %s pushed, got %s: %v", dm[i].Image.Name, um.Image.Name, um.Manifest.Status)
+			}
+			if len(um.Layers) != len(dm[i].Layers)+1 {
+				t.Fatalf("Wanted %d blobs, got %d", len(dm[i].Layers)+1, len(um.Layers))
+			}
+		}
+	})
+
+	t.Run("Fail if the tag cannot be checked", func(t *testing.T) {
+		uploadConfig.Overwrite = false
+		defer func() { uploadConfig.Overwrite = true }()
+		dst.AddFault(registrytest.Fault{Method: http.MethodHead, Path: "/manifests/", Status: http.StatusServiceUnavailable, Times: len(dm)})
+		failed := uploadImages(context.Background(), dm)
+		if len(failed) != len(dm) || failed[0].Code != http.StatusServiceUnavailable {
+			t.Fatalf("Wanted %d failed manifests, got %v", len(dm), failed)
+		}
+	})
+
+	t.Run("Count the failed manifests", func(t *testing.T) {
+		dst.AddFault(registrytest.Fault{Method: http.MethodPut, Path: "/manifests/", Status: http.StatusInternalServerError})
+		if failed := uploadImages(context.Background(), dm); len(failed) != len(dm) {
+			t.Fatalf("Wanted %d failed manifests, got %d", len(dm), len(failed))
+		}
+	})
+}
@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Cache is a content-addressed blob store shared across download runs,
+// blobs are stored under <dir>/<algorithm>/<hex>.
+type Cache struct {
+	Dir string
+}
+
+type Entry struct {
+	Digest  string
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+func New(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir}, nil
+}
+
+// Path returns the path of the blob in the cache, or "" if the digest is invalid.
+func (c *Cache) Path(digest string) string {
+	algo, hex, err := splitDigest(digest)
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(c.Dir, algo, hex)
+}
+
+func (c *Cache) Has(digest string) bool {
+	p := c.Path(digest)
+	if p == "" {
+		return false
+	}
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// Put adds the blob at src to the cache after verifying its digest. The blob is
+// hard-linked if possible and copied otherwise.
+func (c *Cache) Put(digest, src string) error {
+	p := c.Path(digest)
+	if p == "" {
+		return fmt.Errorf("invalid digest %s", digest)
+	}
+	if c.Has(digest) {
+		return nil
+	}
+	if err := Verify(digest, src); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return linkOrCopy(src, p)
+}
+
+// Link puts the cached blob at dst and marks it as recently used.
+func (c *Cache) Link(digest, dst string) error {
+	p := c.Path(digest)
+	if p == "" {
+		return fmt.Errorf("invalid digest %s", digest)
+	}
+	if err := linkOrCopy(p, dst); err != nil {
+		return err
+	}
+	now := time.Now()
+	_ = os.Chtimes(p, now, now)
+	return nil
+}
+
+// List returns the cached blobs, the least recently used first.
+func (c *Cache) List() ([]Entry, error) {
+	var entries []Entry
+	err := filepath.Walk(c.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			return nil
+		}
+		algo := filepath.Base(filepath.Dir(p))
+		entries = append(entries, Entry{
+			Digest:  algo + ":" + fi.Name(),
+			Path:    p,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime.Before(entries[j].ModTime)
+	})
+	return entries, nil
+}
+
+// Du returns the total size and the number of the cached blobs.
+func (c *Cache) Du() (int64, int, error) {
+	entries, err := c.List()
+	if err != nil {
+		return 0, 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	return total, len(entries), nil
+}
+
+// Prune removes the blobs which are not used for longer than maxAge, then
+// removes the least recently used blobs until the cache is not larger than
+// maxSize. A zero maxAge or a negative maxSize means no limit. If dryRun is
+// true, nothing is removed. It returns the pruned blobs.
+func (c *Cache) Prune(maxSize int64, maxAge time.Duration, dryRun bool) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	var pruned []Entry
+	now := time.Now()
+	for _, e := range entries {
+		expired := maxAge > 0 && now.Sub(e.ModTime) > maxAge
+		oversize := maxSize >= 0 && total > maxSize
+		if !expired && !oversize {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(e.Path); err != nil {
+				return pruned, err
+			}
+		}
+		total -= e.Size
+		pruned = append(pruned, e)
+	}
+	return pruned, nil
+}
+
+// Verify checks that the content of the file matches the digest.
+func Verify(digest, file string) error {
+	algo, want, err := splitDigest(digest)
+	if err != nil {
+		return err
+	}
+	if algo != "sha256" {
+		return fmt.Errorf("unsupported digest algorithm %s", algo)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("digest mismatch, want %s, got %s:%s", digest, algo, got)
+	}
+	return nil
+}
+
+func splitDigest(digest string) (string, string, error) {
+	s := strings.SplitN(digest, ":", 2)
+	if len(s) != 2 || s[0] == "" || s[1] == "" {
+		return "", "", fmt.Errorf("invalid digest %s", digest)
+	}
+	for _, r := range s[0] {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'z') {
+			return "", "", fmt.Errorf("invalid digest %s", digest)
+		}
+	}
+	for _, r := range s[1] {
+		if !(r >= '0' && r <= '9' || r >= 'a' && r <= 'f') {
+			return "", "", fmt.Errorf("invalid digest %s", digest)
+		}
+	}
+	return s[0], s[1], nil
+}
+
+func linkOrCopy(src, dst string) error {
+	_ = os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = os.Chmod(tmp.Name(), 0644); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
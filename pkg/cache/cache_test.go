@@ -0,0 +1,97 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeBlob(t *testing.T, dir, content string) (string, string) {
+	sum := sha256.Sum256([]byte(content))
+	digest := "sha256:" + hex.EncodeToString(sum[:])
+	p := filepath.Join(dir, hex.EncodeToString(sum[:])+".tar.gz")
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return digest, p
+}
+
+func TestCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lighting-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c, err := New(filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, src := writeBlob(t, dir, "layer")
+
+	t.Run("Put and link", func(t *testing.T) {
+		if err := c.Put(digest, src); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if !c.Has(digest) {
+			t.Fatal("Wanted true, got false")
+		}
+		dst := filepath.Join(dir, "linked")
+		if err := c.Link(digest, dst); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		data, _ := ioutil.ReadFile(dst)
+		if string(data) != "layer" {
+			t.Fatalf("Wanted layer, got %s", data)
+		}
+	})
+
+	t.Run("Put digest mismatch", func(t *testing.T) {
+		_, other := writeBlob(t, dir, "other")
+		bad := "sha256:" + "0000000000000000000000000000000000000000000000000000000000000000"
+		if err := c.Put(bad, other); err == nil {
+			t.Fatal("Wanted error, got nil")
+		}
+		if c.Has(bad) {
+			t.Fatal("Wanted false, got true")
+		}
+	})
+
+	t.Run("Invalid digest", func(t *testing.T) {
+		if p := c.Path("sha256:../../etc"); p != "" {
+			t.Fatalf("Wanted empty, got %s", p)
+		}
+	})
+
+	t.Run("Du", func(t *testing.T) {
+		size, count, err := c.Du()
+		if err != nil || size != 5 || count != 1 {
+			t.Fatalf("Wanted 5 1, got %d %d %v", size, count, err)
+		}
+	})
+
+	t.Run("Prune by age", func(t *testing.T) {
+		old := time.Now().Add(-48 * time.Hour)
+		_ = os.Chtimes(c.Path(digest), old, old)
+		pruned, err := c.Prune(-1, 24*time.Hour, true)
+		if err != nil || len(pruned) != 1 {
+			t.Fatalf("Wanted 1, got %d %v", len(pruned), err)
+		}
+		if !c.Has(digest) {
+			t.Fatal("Wanted dry run to keep the blob")
+		}
+	})
+
+	t.Run("Prune by size", func(t *testing.T) {
+		pruned, err := c.Prune(0, 0, false)
+		if err != nil || len(pruned) != 1 {
+			t.Fatalf("Wanted 1, got %d %v", len(pruned), err)
+		}
+		if c.Has(digest) {
+			t.Fatal("Wanted false, got true")
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrChaosDrop is the error of the connections dropped by the chaos mode.
+var ErrChaosDrop = errors.New("connection dropped by chaos mode")
+
+// Chaos configures the faults injected into the requests of the client, it is
+// used to rehearse the behaviour of the retries on a bad network.
+type Chaos struct {
+	// Latency is the max latency added to each request, the latency of a
+	// request is random in [0, Latency)
+	Latency time.Duration
+	// DropRate is the rate of the connections dropped in the middle of the
+	// request body, or of the response body if the request has no body
+	DropRate float64
+	// ErrorRate is the rate of the 500, 502 and 503 responses
+	ErrorRate float64
+	// ThrottleRate is the rate of the 429 responses
+	ThrottleRate float64
+	// Seed is the seed of the random faults, 0 uses the current time
+	Seed int64
+}
+
+// ParseChaos parses the chaos spec, a comma separated list of key=value, e.g.
+// latency=200ms,drop=0.05,5xx=0.1,429=0.05,seed=1
+func ParseChaos(spec string) (*Chaos, error) {
+	chaos := &Chaos{}
+	for _, kv := range strings.Split(spec, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		s := strings.SplitN(kv, "=", 2)
+		if len(s) != 2 {
+			return nil, fmt.Errorf("invalid chaos option %q, want key=value", kv)
+		}
+		key, value := strings.TrimSpace(s[0]), strings.TrimSpace(s[1])
+		var err error
+		switch key {
+		case "latency":
+			chaos.Latency, err = time.ParseDuration(value)
+		case "drop":
+			chaos.DropRate, err = parseRate(value)
+		case "5xx":
+			chaos.ErrorRate, err = parseRate(value)
+		case "429":
+			chaos.ThrottleRate, err = parseRate(value)
+		case "seed":
+			chaos.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			return nil, fmt.Errorf("unknown chaos option %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos option %q: %v", kv, err)
+		}
+	}
+	if chaos.ErrorRate+chaos.ThrottleRate > 1 {
+		return nil, fmt.Errorf("the sum of the 5xx and 429 rates is greater than 1")
+	}
+	return chaos, nil
+}
+
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 || rate > 1 {
+		return 0, fmt.Errorf("rate %v is not in [0, 1]", rate)
+	}
+	return rate, nil
+}
+
+func (c Chaos) String() string {
+	return fmt.Sprintf("latency=%s,drop=%v,5xx=%v,429=%v,seed=%d", c.Latency, c.DropRate, c.ErrorRate, c.ThrottleRate, c.Seed)
+}
+
+// SetChaos injects the faults of the chaos into the requests of the client, it
+// wraps the transport, so it must be called after SetSecureSkip.
+func (c *Client) SetChaos(chaos *Chaos) {
+	c.SetTransport(NewChaosTransport(c.GetClient().Transport, chaos))
+}
+
+// NewChaosTransport returns a RoundTripper which injects the faults of the
+// chaos into the requests sent by base, base is http.DefaultTransport if nil.
+func NewChaosTransport(base http.RoundTripper, chaos *Chaos) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	seed := chaos.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &chaosTransport{base: base, chaos: *chaos, rand: rand.New(rand.NewSource(seed))}
+}
+
+type chaosTransport struct {
+	base  http.RoundTripper
+	chaos Chaos
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func (t *chaosTransport) float64() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rand.Float64()
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.chaos.Latency > 0 {
+		select {
+		case <-time.After(time.Duration(t.float64() * float64(t.chaos.Latency))):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	switch r := t.float64(); {
+	case r < t.chaos.ErrorRate:
+		codes := []int{http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable}
+		return faultResponse(req, codes[int(r/t.chaos.ErrorRate*float64(len(codes)))%len(codes)]), nil
+	case r < t.chaos.ErrorRate+t.chaos.ThrottleRate:
+		res := faultResponse(req, http.StatusTooManyRequests)
+		res.Header.Set("Retry-After", "1")
+		return res, nil
+	}
+
+	if t.float64() >= t.chaos.DropRate {
+		return t.base.RoundTrip(req)
+	}
+	if req.Body != nil && req.ContentLength > 0 {
+		// the transport fails as the body is shorter than the content length
+		req = req.Clone(req.Context())
+		req.Body = &dropReader{ReadCloser: req.Body, remaining: int64(t.float64() * float64(req.ContentLength))}
+		return t.base.RoundTrip(req)
+	}
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	res.Body = &dropReader{ReadCloser: res.Body, remaining: int64(t.float64() * float64(res.ContentLength))}
+	return res, nil
+}
+
+// faultResponse returns a response of the status code in the error format of
+// the registry, the request is not sent.
+func faultResponse(req *http.Request, code int) *http.Response {
+	if req.Body != nil {
+		_ = req.Body.Close()
+	}
+	body := `{"errors":[{"code":"UNKNOWN","message":"injected by chaos mode"}]}`
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"application/json"}},
+		Body:          ioutil.NopCloser(bytes.NewReader([]byte(body))),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// dropReader fails with ErrChaosDrop after reading the remaining bytes.
+type dropReader struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *dropReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, ErrChaosDrop
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+)
+
+func TestParseChaos(t *testing.T) {
+	t.Run("Parse chaos", func(t *testing.T) {
+		chaos, err := ParseChaos("latency=200ms, drop=0.05,5xx=0.1,429=0.05,seed=1")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		expected := Chaos{Latency: 200 * time.Millisecond, DropRate: 0.05, ErrorRate: 0.1, ThrottleRate: 0.05, Seed: 1}
+		if *chaos != expected {
+			t.Fatalf("Wanted %v, got %v", expected, chaos)
+		}
+	})
+
+	for _, spec := range []string{"drop", "jitter=1s", "drop=2", "5xx=-0.1", "latency=fast", "5xx=0.6,429=0.6"} {
+		t.Run("Parse invalid chaos "+spec, func(t *testing.T) {
+			if _, err := ParseChaos(spec); err == nil {
+				t.Fatalf("Wanted error, got nil")
+			}
+		})
+	}
+}
+
+func TestChaos(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	content := bytes.Repeat([]byte("layer content "), 4096)
+	digest := r.AddBlob("shipengqi/apiserver", content)
+	dir, err := ioutil.TempDir("", "lighting-chaos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "layer")
+
+	t.Run("Server errors", func(t *testing.T) {
+		c := newTestClient(t, r, "", "")
+		c.SetChaos(&Chaos{ErrorRate: 1})
+		status := c.CheckBlobs(context.Background(), "shipengqi/apiserver", digest)
+		if status.Code < http.StatusInternalServerError {
+			t.Fatalf("Wanted 5xx, got %d", status.Code)
+		}
+	})
+
+	t.Run("Dropped connections", func(t *testing.T) {
+		c := newTestClient(t, r, "", "")
+		c.SetChaos(&Chaos{DropRate: 1})
+		if status := c.FetchBlobs(context.Background(), "shipengqi/apiserver", digest, output, nil); status.Code == OK.Code {
+			t.Fatalf("Wanted error, got %d", status.Code)
+		}
+		if _, err := os.Stat(output); !os.IsNotExist(err) {
+			t.Fatalf("Wanted the output removed, got %v", err)
+		}
+	})
+
+	t.Run("Retry the dropped connections", func(t *testing.T) {
+		c := newTestClient(t, r, "", "")
+		c.SetRetryCount(20)
+		c.SetRetryWaitTime(time.Millisecond)
+		c.SetChaos(&Chaos{DropRate: 0.5, ErrorRate: 0.2, Seed: 1})
+		var progress int64
+		status := c.FetchBlobs(context.Background(), "shipengqi/apiserver", digest, output, func(n int64) { progress += n })
+		if status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d: %s", OK.Code, status.Code, status.Message)
+		}
+		got, _ := ioutil.ReadFile(output)
+		if !bytes.Equal(got, content) || progress != int64(len(content)) {
+			t.Fatalf("Wanted %d bytes, got %d bytes, progress %d", len(content), len(got), progress)
+		}
+	})
+}
@@ -1,11 +1,21 @@
 package client
 
 import (
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 )
@@ -14,6 +24,21 @@ var (
 	BasicAuthType  = "Basic"
 	BearerAuthType = "Bearer"
 	DockerUuidKey  =  "Docker-Upload-Uuid"
+	DockerDigestKey = "Docker-Content-Digest"
+)
+
+var (
+	// TagsPageSize is the number of the tags requested per page.
+	TagsPageSize = 100
+	// CatalogPageSize is the number of the repositories requested per page.
+	CatalogPageSize = 100
+)
+
+var (
+	MediaTypeManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
 )
 
 var (
@@ -25,8 +50,25 @@ var (
 	NotFoundErr       = &Errno{Code: 404, Message: "Not Found."}
 	TooManyRequestErr = &Errno{Code: 429, Message: "Too Many Requests"}
 	InternalServerErr = &Errno{Code: 500, Message: "Internal server error"}
+	CanceledErr       = &Errno{Code: 499, Message: "Canceled"} // the context of the request is canceled
 )
 
+// ProgressFunc is called with the number of bytes transferred since the last call.
+type ProgressFunc func(n int64)
+
+type progressReader struct {
+	io.Reader
+	progress ProgressFunc
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 && r.progress != nil {
+		r.progress(int64(n))
+	}
+	return n, err
+}
+
 type Client struct {
 	*resty.Client
 
@@ -40,7 +82,52 @@ type Client struct {
 }
 
 func New() *Client {
-	return &Client{Client: resty.New()}
+	c := &Client{Client: resty.New()}
+	c.SetPreRequestHook(setContentLength)
+	c.AddRetryCondition(retryable)
+	c.SetRetryAfter(retryAfter)
+	return c
+}
+
+// retryable reports whether the request should be retried, the connection
+// errors, the 5xx and the 429 responses are retried. The requests of a stream
+// body are not retried as the stream cannot be replayed.
+func retryable(res *resty.Response, err error) bool {
+	if res != nil && res.Request != nil {
+		if _, ok := res.Request.Body.(io.Reader); ok {
+			return false
+		}
+	}
+	if err != nil || res == nil {
+		return err != nil
+	}
+	code := res.StatusCode()
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// retryAfter returns the wait time of the Retry-After header in seconds, 0
+// uses the default backoff.
+func retryAfter(_ *resty.Client, res *resty.Response) (time.Duration, error) {
+	if res == nil || res.RawResponse == nil {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(res.Header().Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return 0, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// setContentLength sets the content length of the streamed request bodies
+// from the Content-Length header, which is not sent by net/http otherwise.
+func setContentLength(_ *resty.Client, r *http.Request) error {
+	if r.Body == nil || r.ContentLength > 0 {
+		return nil
+	}
+	if n, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64); err == nil {
+		r.ContentLength = n
+	}
+	return nil
 }
 
 func (c *Client) SetUsername(username string) {
@@ -58,8 +145,9 @@ func (c *Client) SetSecureSkip(skip bool) {
 }
 
 // Ping ping registry and get authenticate info
-func (c *Client) Ping() error {
+func (c *Client) Ping(ctx context.Context) error {
 	res, err := c.R().
+		SetContext(ctx).
 		Get("/v2/")
 	if err != nil {
 		return err
@@ -100,21 +188,35 @@ func (c *Client) Ping() error {
 }
 
 // GetAuthToken get token with scope
-func (c *Client) GetAuthToken(repo string) (error, string) {
+func (c *Client) GetAuthToken(ctx context.Context, repo string) (error, string) {
+	return c.getAuthToken(ctx, fmt.Sprintf("repository:%s:push,pull", repo))
+}
+
+func (c *Client) getAuthToken(ctx context.Context, scope string) (error, string) {
+	// the registry does not require authentication
+	if c.auth.mode == "" {
+		return nil, ""
+	}
 	if c.auth.mode == BearerAuthType {
 		authToken := &AuthToken{}
-		request := c.R()
+		request := c.R().SetContext(ctx)
 		if c.username != "" && c.password != "" {
 			request = request.SetBasicAuth(c.username, c.password)
 		}
-		_, err := request.
+		res, err := request.
 			SetResult(authToken).
 			SetQueryParam("service", c.auth.service).
-			SetQueryParam("scope", fmt.Sprintf("repository:%s:push,pull", repo)).
+			SetQueryParam("scope", scope).
 			Get(c.auth.server)
 		if err != nil {
 			return err, ""
 		}
+		if status := handleResponseStatus(res); status.Code != OK.Code {
+			return &Errno{status.Code, fmt.Sprintf("get token: %s", status.Message)}, ""
+		}
+		if authToken.Token == "" {
+			authToken.Token = authToken.AccessToken
+		}
 		if authToken.Token == "" {
 			return fmt.Errorf("token is null"), ""
 		}
@@ -123,7 +225,7 @@ func (c *Client) GetAuthToken(repo string) (error, string) {
 
 	if c.auth.mode == BasicAuthType {
 		if c.username == "" || c.password == "" {
-			return fmt.Errorf("bad credential"), ""
+			return &Errno{UnauthorizedErr.Code, "bad credential"}, ""
 		}
 		return nil, base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", c.username, c.password)))
 	}
@@ -131,137 +233,401 @@ func (c *Client) GetAuthToken(repo string) (error, string) {
 	return fmt.Errorf("upsupport auth type %s", c.auth.mode), ""
 }
 
-// ListImageTags listing image tags
-func (c *Client) ListImageTags(name string) (*Tags, *Errno) {
-	tags := &Tags{}
-	err, token := c.GetAuthToken(name)
+// authRequest returns a request with the credential of the auth mode of the
+// registry, token is the bearer token returned by GetAuthToken.
+func (c *Client) authRequest(ctx context.Context, token string) *resty.Request {
+	request := c.R().SetContext(ctx)
+	switch c.auth.mode {
+	case BearerAuthType:
+		if token != "" {
+			request.SetAuthToken(token)
+		}
+	case BasicAuthType:
+		request.SetBasicAuth(c.username, c.password)
+	}
+	return request
+}
+
+// ListImageTags listing image tags, the pages of the tags are followed by the
+// Link header, or by the last tag if the registry returns a full page without
+// the Link header.
+func (c *Client) ListImageTags(ctx context.Context, name string) (*Tags, *Errno) {
+	tags := &Tags{Name: name}
+	err, token := c.GetAuthToken(ctx, name)
 	if err != nil {
-		return tags, &Errno{InternalServerErr.Code, err.Error()}
+		return tags, requestErrno(ctx, err)
 	}
-	request := c.R()
-	res, err := request.
-		SetAuthToken(token).
-		SetResult(tags).
-		Get(fmt.Sprintf("/v2/%s/tags/list", name))
+	seen := make(map[string]bool)
+	path := fmt.Sprintf("/v2/%s/tags/list", name)
+	next := fmt.Sprintf("%s?n=%d", path, TagsPageSize)
+	for next != "" {
+		page := &Tags{}
+		request := c.authRequest(ctx, token)
+		res, err := request.
+			SetResult(page).
+			Get(next)
+		if err != nil {
+			return tags, requestErrno(ctx, err)
+		}
+		status := handleResponseStatus(res)
+		if status.Code != OK.Code {
+			return tags, status
+		}
+		added := 0
+		for _, t := range page.Tags {
+			if seen[t] {
+				continue
+			}
+			seen[t] = true
+			tags.Tags = append(tags.Tags, t)
+			added++
+		}
+		if added == 0 {
+			break
+		}
+		next = nextPage(res, path, page.Tags[len(page.Tags)-1], len(page.Tags), TagsPageSize)
+	}
+	return tags, OK
+}
+
+// ListRepositories lists the repositories of the registry catalog, the pages
+// are followed as ListImageTags.
+func (c *Client) ListRepositories(ctx context.Context) (*Catalog, *Errno) {
+	catalog := &Catalog{}
+	err, token := c.getAuthToken(ctx, "registry:catalog:*")
 	if err != nil {
-		return tags, &Errno{InternalServerErr.Code, err.Error()}
+		return catalog, requestErrno(ctx, err)
 	}
-	status := handleResponseStatus(res)
-	return tags, status
+	seen := make(map[string]bool)
+	path := "/v2/_catalog"
+	next := fmt.Sprintf("%s?n=%d", path, CatalogPageSize)
+	for next != "" {
+		page := &Catalog{}
+		request := c.authRequest(ctx, token)
+		res, err := request.
+			SetResult(page).
+			Get(next)
+		if err != nil {
+			return catalog, requestErrno(ctx, err)
+		}
+		status := handleResponseStatus(res)
+		if status.Code != OK.Code {
+			return catalog, status
+		}
+		added := 0
+		for _, r := range page.Repositories {
+			if seen[r] {
+				continue
+			}
+			seen[r] = true
+			catalog.Repositories = append(catalog.Repositories, r)
+			added++
+		}
+		if added == 0 {
+			break
+		}
+		next = nextPage(res, path, page.Repositories[len(page.Repositories)-1], len(page.Repositories), CatalogPageSize)
+	}
+	return catalog, OK
 }
 
-// FetchManifest get manifest of image
-func (c *Client) FetchManifest(name, reference string) (*Manifest, *Errno) {
+// nextPage returns the URL of the next page of a paginated response, it is
+// the Link header with rel="next", or the path with the last item if the page
+// is full. It returns "" if there is no next page.
+func nextPage(res *resty.Response, path, last string, size, pageSize int) string {
+	for _, link := range res.Header()["Link"] {
+		for _, l := range strings.Split(link, ",") {
+			parts := strings.Split(l, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, p := range parts[1:] {
+				if strings.Replace(strings.TrimSpace(p), " ", "", -1) == `rel="next"` {
+					return target
+				}
+			}
+		}
+	}
+	if size < pageSize {
+		return ""
+	}
+	return fmt.Sprintf("%s?n=%d&last=%s", path, pageSize, url.QueryEscape(last))
+}
+
+// FetchManifest get manifest of image, reference is a tag or a digest. If it is
+// a digest, the digest of the fetched manifest must match it
+func (c *Client) FetchManifest(ctx context.Context, name, reference string) (*Manifest, *Errno) {
 	manifest := &Manifest{Image: ImageRepo{Name: name, Tag: reference}}
-	err, token := c.GetAuthToken(name)
+	err, token := c.GetAuthToken(ctx, name)
 	if err != nil {
-		return manifest, &Errno{InternalServerErr.Code, err.Error()}
+		return manifest, requestErrno(ctx, err)
 	}
-	request := c.R()
+	request := c.authRequest(ctx, token)
 	res, err := request.
-		SetHeader("accept", "application/vnd.docker.distribution.manifest.v2+json").
-		SetAuthToken(token).
-		SetResult(manifest).
+		SetHeader("accept", strings.Join([]string{MediaTypeManifest, MediaTypeOCIManifest}, ", ")).
 		Get(fmt.Sprintf("/v2/%s/manifests/%s", name, reference))
 	if err != nil {
-		return manifest, &Errno{InternalServerErr.Code, err.Error()}
+		return manifest, requestErrno(ctx, err)
 	}
 	status := handleResponseStatus(res)
+	if status.Code != OK.Code {
+		return manifest, status
+	}
+	manifest.Raw = res.Body()
+	if err = json.Unmarshal(manifest.Raw, manifest); err != nil {
+		return manifest, &Errno{InternalServerErr.Code, fmt.Sprintf("unmarshal manifest: %v", err)}
+	}
+	if manifest.MediaType == "" {
+		manifest.MediaType = strings.Split(res.Header().Get("Content-Type"), ";")[0]
+	}
+	switch manifest.MediaType {
+	case MediaTypeManifestList, MediaTypeOCIIndex:
+		return manifest, &Errno{BadRequestErr.Code, fmt.Sprintf("manifest list of %s@%s is not supported, use the digest of a platform manifest", name, reference)}
+	}
+	sum := sha256.Sum256(manifest.Raw)
+	manifest.Digest = "sha256:" + hex.EncodeToString(sum[:])
+	if strings.Contains(reference, ":") && reference != manifest.Digest {
+		return manifest, &Errno{BadRequestErr.Code, fmt.Sprintf("manifest digest mismatch, want %s, got %s", reference, manifest.Digest)}
+	}
 	return manifest, status
 }
 
-// FetchBlobs get blobs of image layer digest
-func (c *Client) FetchBlobs(name, digest, output string) *Errno {
-	err, token := c.GetAuthToken(name)
+// HeadManifest get the digest of the manifest from the Docker-Content-Digest
+// header, reference is a tag or a digest. If the registry does not return the
+// header, the manifest is fetched to compute the digest
+func (c *Client) HeadManifest(ctx context.Context, name, reference string) (string, *Errno) {
+	err, token := c.GetAuthToken(ctx, name)
+	if err != nil {
+		return "", requestErrno(ctx, err)
+	}
+	request := c.authRequest(ctx, token)
+	res, err := request.
+		SetHeader("accept", strings.Join([]string{MediaTypeManifest, MediaTypeOCIManifest}, ", ")).
+		Head(fmt.Sprintf("/v2/%s/manifests/%s", name, reference))
+	if err != nil {
+		return "", requestErrno(ctx, err)
+	}
+	status := handleResponseStatus(res)
+	if status.Code != OK.Code {
+		return "", status
+	}
+	if digest := res.Header().Get(DockerDigestKey); digest != "" {
+		return digest, status
+	}
+	manifest, status := c.FetchManifest(ctx, name, reference)
+	return manifest.Digest, status
+}
+
+// PushManifest put the manifest content, reference is a tag or a digest. It
+// returns the digest of the manifest reported by the registry
+func (c *Client) PushManifest(ctx context.Context, name, reference, mediaType string, content []byte) (string, *Errno) {
+	err, token := c.GetAuthToken(ctx, name)
+	if err != nil {
+		return "", requestErrno(ctx, err)
+	}
+	request := c.authRequest(ctx, token)
+	res, err := request.
+		SetBody(content).
+		SetHeader("Content-Type", mediaType).
+		SetContentLength(true).
+		Put(fmt.Sprintf("/v2/%s/manifests/%s", name, reference))
+	if err != nil {
+		return "", requestErrno(ctx, err)
+	}
+	status := handleResponseStatus(res)
+	return res.Header().Get(DockerDigestKey), status
+}
+
+// FetchBlobs get blobs of image layer digest, progress is called with the
+// bytes written to the output, it can be nil. The download is retried from the
+// start if the connection is dropped in the middle of the blob, the progress
+// of the dropped download is rolled back.
+func (c *Client) FetchBlobs(ctx context.Context, name, digest, output string, progress ProgressFunc) *Errno {
+	for attempt := 1; ; attempt++ {
+		var written int64
+		status, dropped := c.fetchBlobs(ctx, name, digest, output, func(n int64) {
+			written += n
+			if progress != nil {
+				progress(n)
+			}
+		})
+		if !dropped || ctx.Err() != nil || attempt >= c.RetryCount {
+			return status
+		}
+		if progress != nil {
+			progress(-written)
+		}
+	}
+}
+
+// fetchBlobs downloads the blob to the output, dropped is true if the copy of
+// the response body fails.
+func (c *Client) fetchBlobs(ctx context.Context, name, digest, output string, progress ProgressFunc) (status *Errno, dropped bool) {
+	err, token := c.GetAuthToken(ctx, name)
+	if err != nil {
+		return requestErrno(ctx, err), false
+	}
+	request := c.authRequest(ctx, token)
+	res, err := request.
+		SetDoNotParseResponse(true).
+		Get(fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	if err != nil {
+		return requestErrno(ctx, err), false
+	}
+	body := res.RawBody()
+	defer body.Close()
+	status = handleResponseStatus(res)
+	if status.Code != OK.Code {
+		return status, false
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return requestErrno(ctx, err), false
+	}
+	_, err = io.Copy(f, &progressReader{Reader: body, progress: progress})
+	dropped = err != nil
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(output)
+		return requestErrno(ctx, err), dropped
+	}
+	return status, false
+}
+
+// OpenBlob opens the content of a blob as a stream, it returns the size of the
+// blob, or -1 if the size is unknown. The caller must close the stream.
+func (c *Client) OpenBlob(ctx context.Context, name, digest string, progress ProgressFunc) (io.ReadCloser, int64, *Errno) {
+	err, token := c.GetAuthToken(ctx, name)
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return nil, 0, requestErrno(ctx, err)
 	}
-	request := c.R()
+	request := c.authRequest(ctx, token)
 	res, err := request.
-		SetAuthToken(token).
-		SetOutput(output).
+		SetDoNotParseResponse(true).
 		Get(fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return nil, 0, requestErrno(ctx, err)
 	}
+	body := res.RawBody()
 	status := handleResponseStatus(res)
-	return status
+	if status.Code != OK.Code {
+		_ = body.Close()
+		return nil, 0, status
+	}
+	stream := struct {
+		io.Reader
+		io.Closer
+	}{&progressReader{Reader: body, progress: progress}, body}
+	return stream, res.RawResponse.ContentLength, status
 }
 
 // CheckBlobs check the existence of a layer
-func (c *Client) CheckBlobs(name, digest string) *Errno {
-	err, token := c.GetAuthToken(name)
+func (c *Client) CheckBlobs(ctx context.Context, name, digest string) *Errno {
+	err, token := c.GetAuthToken(ctx, name)
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return requestErrno(ctx, err)
 	}
-	request := c.R()
+	request := c.authRequest(ctx, token)
 	res, err := request.
-		SetAuthToken(token).
 		Head(fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return requestErrno(ctx, err)
 	}
 	status := handleResponseStatus(res)
 	return status
 }
 
 // StartUpload starting an upload
-func (c *Client) StartUpload(name string) *Errno {
-	err, token := c.GetAuthToken(name)
+func (c *Client) StartUpload(ctx context.Context, name string) *Errno {
+	err, token := c.GetAuthToken(ctx, name)
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return requestErrno(ctx, err)
 	}
-	request := c.R()
+	request := c.authRequest(ctx, token)
 	res, err := request.
-		SetAuthToken(token).
 		Post(fmt.Sprintf("/v2/%s/blobs/uploads", name))
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return requestErrno(ctx, err)
 	}
 	status := handleResponseStatus(res)
 	// Set docker uuid
 	if status.Code == OK.Code {
-		status.Message = res.Header().Get(DockerUuidKey)
+		return &Errno{Code: status.Code, Message: res.Header().Get(DockerUuidKey)}
 	}
 	return status
 }
 
 // PushBlobs upload a layer
-func (c *Client) PushBlobs(name, digest, uuid, path string) *Errno {
-	err, token := c.GetAuthToken(name)
+func (c *Client) PushBlobs(ctx context.Context, name, digest, uuid, path string) *Errno {
+	err, token := c.GetAuthToken(ctx, name)
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return requestErrno(ctx, err)
 	}
 	fileBytes, _ := ioutil.ReadFile(path)
-	request := c.R()
+	request := c.authRequest(ctx, token)
 	res, err := request.
 		SetBody(fileBytes).
 		SetHeader("Content-Type", "application/octet-stream").
-		SetAuthToken(token).
 		SetContentLength(true).
 		Put(fmt.Sprintf("/v2/%s/blobs/uploads/%s?digest=%s", name, uuid, digest))
 	if err != nil {
-		return &Errno{InternalServerErr.Code, err.Error()}
+		return requestErrno(ctx, err)
 	}
 	status := handleResponseStatus(res)
 	return status
 }
 
+// PushBlobStream upload a layer from a stream without buffering it, size is
+// the size of the layer.
+func (c *Client) PushBlobStream(ctx context.Context, name, digest, uuid string, body io.Reader, size int64) *Errno {
+	err, token := c.GetAuthToken(ctx, name)
+	if err != nil {
+		return requestErrno(ctx, err)
+	}
+	request := c.authRequest(ctx, token)
+	res, err := request.
+		SetBody(body).
+		SetHeader("Content-Type", "application/octet-stream").
+		SetHeader("Content-Length", strconv.FormatInt(size, 10)).
+		Put(fmt.Sprintf("/v2/%s/blobs/uploads/%s?digest=%s", name, uuid, digest))
+	if err != nil {
+		return requestErrno(ctx, err)
+	}
+	status := handleResponseStatus(res)
+	return status
+}
+
+// requestErrno returns the Errno of the error of a request, it is CanceledErr
+// if the context is done. The Errno of the auth token is returned as is.
+func requestErrno(ctx context.Context, err error) *Errno {
+	if ctx.Err() != nil {
+		return &Errno{CanceledErr.Code, ctx.Err().Error()}
+	}
+	if e, ok := err.(*Errno); ok {
+		return e
+	}
+	return &Errno{InternalServerErr.Code, err.Error()}
+}
+
+// handleResponseStatus returns OK for the 2xx and 3xx responses, or an Errno
+// with the status code and the error message of the registry.
 func handleResponseStatus(res *resty.Response) *Errno {
 	if res == nil {
 		return InternalServerErr
 	}
-	switch res.StatusCode() {
-	case BadRequestErr.Code:
-		return BadRequestErr
-	case UnauthorizedErr.Code:
-		return BadRequestErr
-	case ForbiddenErr.Code:
-		return BadRequestErr
-	case NotFoundErr.Code:
-		return BadRequestErr
-	case TooManyRequestErr.Code:
-		return BadRequestErr
-	}
-	return OK
+	code := res.StatusCode()
+	if code < 400 {
+		return OK
+	}
+	message := fmt.Sprintf("%d %s", code, http.StatusText(code))
+	body := &struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}{}
+	if err := json.Unmarshal(res.Body(), body); err == nil && len(body.Errors) > 0 {
+		message = fmt.Sprintf("%s: %s %s", message, body.Errors[0].Code, body.Errors[0].Message)
+	}
+	return &Errno{Code: code, Message: message}
 }
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/shipengqi/lighting-i/pkg/docker/registry/registrytest"
+)
+
+func newTestClient(t *testing.T, r *registrytest.Registry, username, password string) *Client {
+	c := New()
+	c.SetHostURL(r.URL)
+	c.SetUsername(username)
+	c.SetPassword(password)
+	if err := c.Ping(context.Background()); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	return c
+}
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		title    string
+		option   []registrytest.Option
+		password string
+		code     int
+	}{
+		{"Anonymous", nil, "", OK.Code},
+		{"Basic auth", []registrytest.Option{registrytest.WithBasicAuth("admin", "secret")}, "secret", OK.Code},
+		{"Basic auth with a wrong password", []registrytest.Option{registrytest.WithBasicAuth("admin", "secret")}, "wrong", http.StatusUnauthorized},
+		{"Bearer auth", []registrytest.Option{registrytest.WithBearerAuth("admin", "secret")}, "secret", OK.Code},
+		{"Bearer auth with a wrong password", []registrytest.Option{registrytest.WithBearerAuth("admin", "secret")}, "wrong", http.StatusUnauthorized},
+	}
+	for _, v := range tests {
+		t.Run(v.title, func(t *testing.T) {
+			r := registrytest.New(v.option...)
+			defer r.Close()
+			digest := r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("layer"))
+			c := newTestClient(t, r, "admin", v.password)
+			m, status := c.FetchManifest(context.Background(), "shipengqi/apiserver", "v1.0.0")
+			if status.Code != v.code {
+				t.Fatalf("Wanted %d, got %d: %s", v.code, status.Code, status.Message)
+			}
+			if status.Code == OK.Code && m.Digest != digest {
+				t.Fatalf("Wanted %s, got %s", digest, m.Digest)
+			}
+		})
+	}
+}
+
+func TestManifest(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	digest := r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("layer1"), []byte("layer2"))
+	c := newTestClient(t, r, "", "")
+
+	t.Run("Fetch manifest", func(t *testing.T) {
+		m, status := c.FetchManifest(context.Background(), "shipengqi/apiserver", "v1.0.0")
+		if status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+		}
+		if len(m.Layers) != 2 || m.MediaType != MediaTypeManifest {
+			t.Fatalf("Wanted 2 layers of %s, got %d layers of %s", MediaTypeManifest, len(m.Layers), m.MediaType)
+		}
+	})
+
+	t.Run("Head manifest", func(t *testing.T) {
+		d, status := c.HeadManifest(context.Background(), "shipengqi/apiserver", "v1.0.0")
+		if status.Code != OK.Code || d != digest {
+			t.Fatalf("Wanted %s, got %s, %d", digest, d, status.Code)
+		}
+		if _, status = c.HeadManifest(context.Background(), "shipengqi/apiserver", "v2.0.0"); status.Code != http.StatusNotFound {
+			t.Fatalf("Wanted %d, got %d", http.StatusNotFound, status.Code)
+		}
+	})
+
+	t.Run("Push manifest", func(t *testing.T) {
+		content, _ := r.Manifest("shipengqi/apiserver", "v1.0.0")
+		d, status := c.PushManifest(context.Background(), "shipengqi/apiserver", "v1.0.1", MediaTypeManifest, content)
+		if status.Code != OK.Code || d != digest {
+			t.Fatalf("Wanted %s, got %s, %d", digest, d, status.Code)
+		}
+		// the blobs are not in the repository
+		_, status = c.PushManifest(context.Background(), "shipengqi/kube-apiserver", "v1.0.0", MediaTypeManifest, content)
+		if status.Code != http.StatusBadRequest {
+			t.Fatalf("Wanted %d, got %d", http.StatusBadRequest, status.Code)
+		}
+	})
+}
+
+func TestBlobs(t *testing.T) {
+	r := registrytest.New(registrytest.WithBasicAuth("admin", "secret"))
+	defer r.Close()
+	content := []byte("layer content")
+	digest := r.AddBlob("shipengqi/apiserver", content)
+	c := newTestClient(t, r, "admin", "secret")
+	dir, err := ioutil.TempDir("", "lighting-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	t.Run("Fetch blob", func(t *testing.T) {
+		output := filepath.Join(dir, "layer")
+		var progress int64
+		status := c.FetchBlobs(context.Background(), "shipengqi/apiserver", digest, output, func(n int64) { progress += n })
+		if status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+		}
+		got, _ := ioutil.ReadFile(output)
+		if !bytes.Equal(got, content) || progress != int64(len(content)) {
+			t.Fatalf("Wanted %q, got %q, progress %d", content, got, progress)
+		}
+	})
+
+	t.Run("Check blob", func(t *testing.T) {
+		if status := c.CheckBlobs(context.Background(), "shipengqi/apiserver", digest); status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+		}
+		if status := c.CheckBlobs(context.Background(), "shipengqi/kube-apiserver", digest); status.Code != http.StatusNotFound {
+			t.Fatalf("Wanted %d, got %d", http.StatusNotFound, status.Code)
+		}
+	})
+
+	t.Run("Push blob", func(t *testing.T) {
+		layer := []byte("pushed layer")
+		path := filepath.Join(dir, "pushed")
+		_ = ioutil.WriteFile(path, layer, 0644)
+		status := c.StartUpload(context.Background(), "shipengqi/kube-apiserver")
+		if status.Code != OK.Code || status.Message == "" {
+			t.Fatalf("Wanted an upload uuid, got %d, %q", status.Code, status.Message)
+		}
+		d := registrytest.Digest(layer)
+		if status = c.PushBlobs(context.Background(), "shipengqi/kube-apiserver", d, status.Message, path); status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d: %s", OK.Code, status.Code, status.Message)
+		}
+		if !r.HasBlob("shipengqi/kube-apiserver", d) {
+			t.Fatalf("Wanted blob %s, got none", d)
+		}
+	})
+
+	t.Run("Push blob with a wrong digest", func(t *testing.T) {
+		status := c.StartUpload(context.Background(), "shipengqi/kube-apiserver")
+		status = c.PushBlobStream(context.Background(), "shipengqi/kube-apiserver", digest, status.Message, bytes.NewReader([]byte("other")), 5)
+		if status.Code != http.StatusBadRequest {
+			t.Fatalf("Wanted %d, got %d", http.StatusBadRequest, status.Code)
+		}
+	})
+
+	t.Run("Stream blob", func(t *testing.T) {
+		var progress int64
+		body, size, status := c.OpenBlob(context.Background(), "shipengqi/apiserver", digest, func(n int64) { progress += n })
+		if status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+		}
+		defer body.Close()
+		if size != int64(len(content)) {
+			t.Fatalf("Wanted %d, got %d", len(content), size)
+		}
+		status = c.StartUpload(context.Background(), "shipengqi/controller")
+		if status = c.PushBlobStream(context.Background(), "shipengqi/controller", digest, status.Message, body, size); status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d: %s", OK.Code, status.Code, status.Message)
+		}
+		if !r.HasBlob("shipengqi/controller", digest) || progress != size {
+			t.Fatalf("Wanted blob %s and progress %d, got progress %d", digest, size, progress)
+		}
+		if _, _, status = c.OpenBlob(context.Background(), "shipengqi/apiserver", "sha256:missing", nil); status.Code != http.StatusNotFound {
+			t.Fatalf("Wanted %d, got %d", http.StatusNotFound, status.Code)
+		}
+	})
+}
+
+func TestFaults(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("layer"))
+	c := newTestClient(t, r, "", "")
+
+	t.Run("Server error", func(t *testing.T) {
+		r.AddFault(registrytest.Fault{Method: http.MethodGet, Path: "/manifests/", Status: http.StatusServiceUnavailable, Times: 1})
+		_, status := c.FetchManifest(context.Background(), "shipengqi/apiserver", "v1.0.0")
+		if status.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Wanted %d, got %d", http.StatusServiceUnavailable, status.Code)
+		}
+		if _, status = c.FetchManifest(context.Background(), "shipengqi/apiserver", "v1.0.0"); status.Code != OK.Code {
+			t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+		}
+	})
+}
+
+func TestListImageTags(t *testing.T) {
+	pageSize := TagsPageSize
+	TagsPageSize = 10
+	defer func() { TagsPageSize = pageSize }()
+
+	tests := []struct {
+		title  string
+		option []registrytest.Option
+	}{
+		{"Link header", nil},
+		{"Without link header", []registrytest.Option{registrytest.WithoutLinkHeader()}},
+		{"Page limit", []registrytest.Option{registrytest.WithPageLimit(4)}},
+	}
+	for _, v := range tests {
+		t.Run(v.title, func(t *testing.T) {
+			r := registrytest.New(v.option...)
+			defer r.Close()
+			for i := 0; i < 25; i++ {
+				r.AddImage("shipengqi/apiserver", fmt.Sprintf("1.5.0-%03d", i))
+			}
+			c := newTestClient(t, r, "", "")
+			list, status := c.ListImageTags(context.Background(), "shipengqi/apiserver")
+			if status.Code != OK.Code {
+				t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+			}
+			if len(list.Tags) != 25 {
+				t.Fatalf("Wanted 25, got %d", len(list.Tags))
+			}
+		})
+	}
+
+	t.Run("List tags of a missing repo", func(t *testing.T) {
+		r := registrytest.New()
+		defer r.Close()
+		c := newTestClient(t, r, "", "")
+		if _, status := c.ListImageTags(context.Background(), "shipengqi/missing"); status.Code != http.StatusNotFound {
+			t.Fatalf("Wanted %d, got %d", http.StatusNotFound, status.Code)
+		}
+	})
+}
+
+func TestListRepositories(t *testing.T) {
+	pageSize := CatalogPageSize
+	CatalogPageSize = 10
+	defer func() { CatalogPageSize = pageSize }()
+
+	for _, link := range []bool{true, false} {
+		t.Run(fmt.Sprintf("List all repositories, link %v", link), func(t *testing.T) {
+			var options []registrytest.Option
+			if !link {
+				options = append(options, registrytest.WithoutLinkHeader())
+			}
+			r := registrytest.New(append(options, registrytest.WithBearerAuth("admin", "secret"))...)
+			defer r.Close()
+			for i := 0; i < 35; i++ {
+				r.AddImage(fmt.Sprintf("vendor/repo-%02d", i), "latest")
+			}
+			c := newTestClient(t, r, "admin", "secret")
+			catalog, status := c.ListRepositories(context.Background())
+			if status.Code != OK.Code {
+				t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+			}
+			if len(catalog.Repositories) != 35 {
+				t.Fatalf("Wanted 35, got %d", len(catalog.Repositories))
+			}
+		})
+	}
+}
+
+func TestCancel(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	digest := r.AddBlob("shipengqi/apiserver", []byte("layer content"))
+	c := newTestClient(t, r, "", "")
+	c.SetRetryCount(3)
+	dir, err := ioutil.TempDir("", "lighting-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "layer")
+
+	r.AddFault(registrytest.Fault{Method: http.MethodGet, Path: "/blobs/", Delay: 500 * time.Millisecond})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	status := c.FetchBlobs(ctx, "shipengqi/apiserver", digest, output, nil)
+	if status.Code != CanceledErr.Code {
+		t.Fatalf("Wanted %d, got %d: %s", CanceledErr.Code, status.Code, status.Message)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("Wanted the output removed, got %v", err)
+	}
+	if n := r.Requests(http.MethodGet, "/blobs/"); n != 1 {
+		t.Fatalf("Wanted 1, got %d", n)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	r.AddImage("shipengqi/apiserver", "v1.0.0", []byte("layer"))
+	c := newTestClient(t, r, "", "")
+	c.SetRetryCount(3)
+	c.SetRetryWaitTime(time.Millisecond)
+
+	for _, code := range []int{http.StatusServiceUnavailable, http.StatusTooManyRequests} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			before := r.Requests(http.MethodGet, "/tags/list")
+			r.AddFault(registrytest.Fault{Method: http.MethodGet, Path: "/tags/list", Status: code, Times: 2})
+			if _, status := c.ListImageTags(context.Background(), "shipengqi/apiserver"); status.Code != OK.Code {
+				t.Fatalf("Wanted %d, got %d", OK.Code, status.Code)
+			}
+			if n := r.Requests(http.MethodGet, "/tags/list") - before; n != 3 {
+				t.Fatalf("Wanted 3, got %d", n)
+			}
+		})
+	}
+
+	t.Run("Not found", func(t *testing.T) {
+		before := r.Requests(http.MethodGet, "/manifests/")
+		if _, status := c.FetchManifest(context.Background(), "shipengqi/apiserver", "v2.0.0"); status.Code != http.StatusNotFound {
+			t.Fatalf("Wanted %d, got %d", http.StatusNotFound, status.Code)
+		}
+		if n := r.Requests(http.MethodGet, "/manifests/") - before; n != 1 {
+			t.Fatalf("Wanted 1, got %d", n)
+		}
+	})
+
+	t.Run("Stream body", func(t *testing.T) {
+		content := []byte("streamed layer")
+		status := c.StartUpload(context.Background(), "shipengqi/apiserver")
+		r.AddFault(registrytest.Fault{Method: http.MethodPut, Path: "/blobs/uploads/", Status: http.StatusServiceUnavailable, Times: 1})
+		status = c.PushBlobStream(context.Background(), "shipengqi/apiserver", registrytest.Digest(content), status.Message, bytes.NewReader(content), int64(len(content)))
+		if status.Code != http.StatusServiceUnavailable {
+			t.Fatalf("Wanted %d, got %d", http.StatusServiceUnavailable, status.Code)
+		}
+	})
+}
@@ -8,8 +8,14 @@ type AuthToken struct {
 }
 
 type ImageRepo struct {
-	Name string
-	Tag  string
+	// Registry is the registry host of the image, it is empty for the default registry
+	Registry string `json:",omitempty"`
+	Name     string
+	Tag      string
+	// Digest is the digest the image is pinned to, it is empty if the image is not pinned
+	Digest string `json:",omitempty"`
+	// Pattern is the tag pattern the tag is resolved from, it is empty if the tag is in the image set
+	Pattern string `json:",omitempty"`
 }
 
 type Manifest struct {
@@ -18,11 +24,15 @@ type Manifest struct {
 	Config        Layer   `json:"config"`
 	Layers        []Layer `json:"layers"`
 	Image         ImageRepo
+	// Digest is the digest of the manifest content
+	Digest string `json:",omitempty"`
+	// Raw is the manifest content returned by the registry
+	Raw []byte `json:"-"`
 }
 
 type Layer struct {
 	MediaType string `json:"mediaType"`
-	Size      int    `json:"size"`
+	Size      int64  `json:"size"`
 	Digest    string `json:"digest"`
 }
 
@@ -30,3 +40,7 @@ type Tags struct {
 	Name string   `json:"name"`
 	Tags []string `json:"tags"`
 }
+
+type Catalog struct {
+	Repositories []string `json:"repositories"`
+}
@@ -0,0 +1,540 @@
+// Package registrytest provides an in-memory Docker registry for tests. It
+// implements the auth challenges, the manifests, the blobs, the monolithic and
+// chunked uploads, the paginated tags list and catalog of the Docker Registry
+// HTTP API V2, and injects the configured faults.
+package registrytest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MediaTypeManifest = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeConfig   = "application/vnd.docker.container.image.v1+json"
+	MediaTypeLayer    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	_token = "registrytest-token"
+)
+
+// Fault makes the matched requests fail.
+type Fault struct {
+	// Method is the method of the requests, empty matches every method
+	Method string
+	// Path is a regular expression matched against the request path
+	Path string
+	// Status is the status code of the response
+	Status int
+	// Times is the number of the requests to fail, 0 fails every request
+	Times int
+	// Delay is the delay before the response
+	Delay time.Duration
+
+	re *regexp.Regexp
+}
+
+// Option configures the registry.
+type Option func(*Registry)
+
+// WithBasicAuth requires the basic auth credential.
+func WithBasicAuth(username, password string) Option {
+	return func(r *Registry) {
+		r.auth, r.username, r.password = "Basic", username, password
+	}
+}
+
+// WithBearerAuth requires a bearer token, which is issued by the /token
+// endpoint of the registry for the basic auth credential.
+func WithBearerAuth(username, password string) Option {
+	return func(r *Registry) {
+		r.auth, r.username, r.password = "Bearer", username, password
+	}
+}
+
+// WithPageLimit limits the number of the items of a page of the tags list and
+// the catalog, whatever the request asks for.
+func WithPageLimit(n int) Option {
+	return func(r *Registry) {
+		r.pageLimit = n
+	}
+}
+
+// WithoutLinkHeader omits the Link header of the paginated responses.
+func WithoutLinkHeader() Option {
+	return func(r *Registry) {
+		r.noLink = true
+	}
+}
+
+// Registry is an in-memory registry served by an httptest.Server.
+type Registry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	auth      string
+	username  string
+	password  string
+	pageLimit int
+	noLink    bool
+	repos     map[string]*repository
+	blobs     map[string][]byte
+	uploads   map[string]*bytes.Buffer
+	faults    []*Fault
+	requests  []string
+	nextID    int
+}
+
+type repository struct {
+	tags      map[string]string
+	manifests map[string]manifest
+	blobs     map[string]bool
+}
+
+type manifest struct {
+	mediaType string
+	content   []byte
+}
+
+// New starts a registry, the caller must call Close.
+func New(opts ...Option) *Registry {
+	r := &Registry{
+		repos:   make(map[string]*repository),
+		blobs:   make(map[string][]byte),
+		uploads: make(map[string]*bytes.Buffer),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// Host returns the host of the registry, e.g. 127.0.0.1:34567.
+func (r *Registry) Host() string {
+	u, _ := url.Parse(r.URL)
+	return u.Host
+}
+
+// Digest returns the sha256 digest of the content.
+func Digest(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// AddBlob adds the blob to the repository and returns its digest.
+func (r *Registry) AddBlob(name string, content []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := Digest(content)
+	r.blobs[d] = content
+	r.repo(name).blobs[d] = true
+	return d
+}
+
+// AddImage adds an image of the layers to the repository, a config blob is
+// generated. It returns the digest of the manifest.
+func (r *Registry) AddImage(name, tag string, layers ...[]byte) string {
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Size      int    `json:"size"`
+		Digest    string `json:"digest"`
+	}
+	config := []byte(fmt.Sprintf(`{"architecture":"amd64","os":"linux","tag":%q}`, name+":"+tag))
+	m := struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}{2, MediaTypeManifest, descriptor{MediaTypeConfig, len(config), r.AddBlob(name, config)}, []descriptor{}}
+	for _, l := range layers {
+		m.Layers = append(m.Layers, descriptor{MediaTypeLayer, len(l), r.AddBlob(name, l)})
+	}
+	content, _ := json.Marshal(m)
+	return r.PutManifest(name, tag, MediaTypeManifest, content)
+}
+
+// PutManifest adds the manifest to the repository, reference is a tag or the
+// digest of the content. It returns the digest of the manifest.
+func (r *Registry) PutManifest(name, reference, mediaType string, content []byte) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	d := Digest(content)
+	repo := r.repo(name)
+	repo.manifests[d] = manifest{mediaType, content}
+	if !strings.HasPrefix(reference, "sha256:") {
+		repo.tags[reference] = d
+	}
+	return d
+}
+
+// Manifest returns the manifest content of the tag or the digest.
+func (r *Registry) Manifest(name, reference string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.manifest(name, reference)
+	return m.content, ok
+}
+
+// HasBlob reports whether the repository has the blob.
+func (r *Registry) HasBlob(name, digest string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	repo, ok := r.repos[name]
+	return ok && repo.blobs[digest]
+}
+
+// AddFault injects the fault, the faults are matched in the order they are
+// added.
+func (r *Registry) AddFault(f Fault) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f.re = regexp.MustCompile(f.Path)
+	r.faults = append(r.faults, &f)
+}
+
+// Requests returns the number of the requests of the method whose path
+// matches the regular expression, empty method matches every method.
+func (r *Registry) Requests(method, path string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	re := regexp.MustCompile(path)
+	var n int
+	for _, req := range r.requests {
+		s := strings.SplitN(req, " ", 2)
+		if (method == "" || s[0] == method) && re.MatchString(s[1]) {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *Registry) repo(name string) *repository {
+	repo, ok := r.repos[name]
+	if !ok {
+		repo = &repository{tags: make(map[string]string), manifests: make(map[string]manifest), blobs: make(map[string]bool)}
+		r.repos[name] = repo
+	}
+	return repo
+}
+
+func (r *Registry) manifest(name, reference string) (manifest, bool) {
+	repo, ok := r.repos[name]
+	if !ok {
+		return manifest{}, false
+	}
+	if d, ok := repo.tags[reference]; ok {
+		reference = d
+	}
+	m, ok := repo.manifests[reference]
+	return m, ok
+}
+
+// fault returns the first matched fault of the request.
+func (r *Registry) fault(req *http.Request) *Fault {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, req.Method+" "+req.URL.Path)
+	for i, f := range r.faults {
+		if (f.Method != "" && f.Method != req.Method) || !f.re.MatchString(req.URL.Path) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				r.faults = append(r.faults[:i], r.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	if f := r.fault(req); f != nil {
+		time.Sleep(f.Delay)
+		if f.Status != 0 {
+			writeError(w, f.Status, "UNKNOWN", "injected fault")
+			return
+		}
+	}
+	if req.URL.Path == "/token" {
+		r.serveToken(w, req)
+		return
+	}
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if !r.authorized(req) {
+		if r.auth == "Bearer" {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registrytest"`, r.URL))
+		} else {
+			w.Header().Set("WWW-Authenticate", `Basic realm="registrytest"`)
+		}
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+
+	p := strings.TrimPrefix(req.URL.Path, "/v2/")
+	switch {
+	case req.URL.Path == "/v2/" || req.URL.Path == "/v2":
+		w.WriteHeader(http.StatusOK)
+	case p == "_catalog":
+		r.mu.Lock()
+		var names []string
+		for n := range r.repos {
+			names = append(names, n)
+		}
+		r.mu.Unlock()
+		r.serveList(w, req, names, func(items []string) interface{} {
+			return map[string][]string{"repositories": items}
+		})
+	case strings.HasSuffix(p, "/tags/list"):
+		name := strings.TrimSuffix(p, "/tags/list")
+		r.mu.Lock()
+		repo, ok := r.repos[name]
+		var tags []string
+		if ok {
+			for t := range repo.tags {
+				tags = append(tags, t)
+			}
+		}
+		r.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", "repository name not known to registry")
+			return
+		}
+		r.serveList(w, req, tags, func(items []string) interface{} {
+			return map[string]interface{}{"name": name, "tags": items}
+		})
+	case strings.Contains(p, "/blobs/uploads"):
+		i := strings.Index(p, "/blobs/uploads")
+		r.serveUpload(w, req, p[:i], strings.Trim(p[i+len("/blobs/uploads"):], "/"))
+	case strings.Contains(p, "/blobs/"):
+		i := strings.LastIndex(p, "/blobs/")
+		r.serveBlob(w, req, p[:i], p[i+len("/blobs/"):])
+	case strings.Contains(p, "/manifests/"):
+		i := strings.LastIndex(p, "/manifests/")
+		r.serveManifest(w, req, p[:i], p[i+len("/manifests/"):])
+	default:
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+	}
+}
+
+func (r *Registry) authorized(req *http.Request) bool {
+	switch r.auth {
+	case "Basic":
+		user, password, ok := req.BasicAuth()
+		return ok && user == r.username && password == r.password
+	case "Bearer":
+		return req.Header.Get("Authorization") == "Bearer "+_token
+	}
+	return true
+}
+
+func (r *Registry) serveToken(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		user, password, ok := req.BasicAuth()
+		if !ok || user != r.username || password != r.password {
+			writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "invalid credential")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"token": _token, "access_token": _token, "expires_in": 300})
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, name, reference string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		r.mu.Lock()
+		m, ok := r.manifest(name, reference)
+		r.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest unknown")
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", Digest(m.content))
+		w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(m.content)
+		}
+	case http.MethodPut:
+		content, _ := ioutil.ReadAll(req.Body)
+		d := Digest(content)
+		if strings.HasPrefix(reference, "sha256:") && reference != d {
+			writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+			return
+		}
+		m := &struct {
+			Config struct {
+				Digest string `json:"digest"`
+			} `json:"config"`
+			Layers []struct {
+				Digest string `json:"digest"`
+			} `json:"layers"`
+		}{}
+		if err := json.Unmarshal(content, m); err != nil {
+			writeError(w, http.StatusBadRequest, "MANIFEST_INVALID", err.Error())
+			return
+		}
+		for _, b := range append([]string{m.Config.Digest}, layerDigests(m.Layers)...) {
+			if !r.HasBlob(name, b) {
+				writeError(w, http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob unknown to registry: "+b)
+				return
+			}
+		}
+		r.PutManifest(name, reference, req.Header.Get("Content-Type"), content)
+		w.Header().Set("Docker-Content-Digest", d)
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/manifests/%s", name, d))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+	}
+}
+
+func layerDigests(layers []struct {
+	Digest string `json:"digest"`
+}) []string {
+	var ds []string
+	for _, l := range layers {
+		ds = append(ds, l.Digest)
+	}
+	return ds
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, name, digest string) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+		return
+	}
+	r.mu.Lock()
+	repo, ok := r.repos[name]
+	content, exists := r.blobs[digest]
+	ok = ok && repo.blobs[digest] && exists
+	r.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "blob unknown to registry")
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Docker-Content-Digest", digest)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+}
+
+// serveUpload serves the uploads: POST starts an upload, or uploads the blob
+// monolithically with the digest, PATCH uploads a chunk, and PUT completes the
+// upload with the last chunk.
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, name, id string) {
+	body, _ := ioutil.ReadAll(req.Body)
+	digest := req.URL.Query().Get("digest")
+	switch {
+	case req.Method == http.MethodPost && id == "":
+		if digest != "" {
+			r.completeUpload(w, name, digest, body)
+			return
+		}
+		r.mu.Lock()
+		r.nextID++
+		id = fmt.Sprintf("upload-%d", r.nextID)
+		r.uploads[id] = &bytes.Buffer{}
+		r.mu.Unlock()
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+		w.Header().Set("Docker-Upload-UUID", id)
+		w.Header().Set("Range", "0-0")
+		w.WriteHeader(http.StatusAccepted)
+	case req.Method == http.MethodPatch || req.Method == http.MethodPut:
+		r.mu.Lock()
+		buf, ok := r.uploads[id]
+		if ok {
+			buf.Write(body)
+		}
+		r.mu.Unlock()
+		if !ok {
+			writeError(w, http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "blob upload unknown to registry")
+			return
+		}
+		if req.Method == http.MethodPatch {
+			w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%s", name, id))
+			w.Header().Set("Docker-Upload-UUID", id)
+			w.Header().Set("Range", fmt.Sprintf("0-%d", buf.Len()-1))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		r.mu.Lock()
+		delete(r.uploads, id)
+		r.mu.Unlock()
+		r.completeUpload(w, name, digest, buf.Bytes())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the operation is unsupported")
+	}
+}
+
+func (r *Registry) completeUpload(w http.ResponseWriter, name, digest string, content []byte) {
+	if digest != Digest(content) {
+		writeError(w, http.StatusBadRequest, "DIGEST_INVALID", "provided digest did not match uploaded content")
+		return
+	}
+	r.AddBlob(name, content)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/%s", name, digest))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// serveList serves a page of the sorted items after the query parameter last.
+func (r *Registry) serveList(w http.ResponseWriter, req *http.Request, items []string, body func([]string) interface{}) {
+	sort.Strings(items)
+	q := req.URL.Query()
+	n := len(items)
+	if v, err := strconv.Atoi(q.Get("n")); err == nil && v >= 0 {
+		n = v
+	}
+	if r.pageLimit > 0 && n > r.pageLimit {
+		n = r.pageLimit
+	}
+	// an empty page has no next page
+	if n == 0 {
+		writeJSON(w, http.StatusOK, body([]string{}))
+		return
+	}
+	start := 0
+	if last := q.Get("last"); last != "" {
+		start = sort.SearchStrings(items, last)
+		if start < len(items) && items[start] == last {
+			start++
+		}
+	}
+	end := len(items)
+	if start+n < end {
+		end = start + n
+		if !r.noLink {
+			next := url.Values{"n": {strconv.Itoa(n)}, "last": {items[end-1]}}
+			w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, req.URL.Path, next.Encode()))
+		}
+	}
+	page := items[start:end]
+	if page == nil {
+		page = []string{}
+	}
+	writeJSON(w, http.StatusOK, body(page))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string][]map[string]string{"errors": {{"code": code, "message": message}}})
+}
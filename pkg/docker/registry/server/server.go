@@ -0,0 +1,262 @@
+// Package server implements the read side of the Docker Registry HTTP API V2
+// over the blobs and the manifests of a download directory.
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	_apiVersionKey = "Docker-Distribution-API-Version"
+	_apiVersion    = "registry/2.0"
+	_digestKey     = "Docker-Content-Digest"
+	_defaultPage   = 100
+)
+
+// Image is an image served by the registry.
+type Image struct {
+	// Name is the repository of the image, e.g. shipengqi/apiserver
+	Name string
+	// Tag is empty if the image is pinned to a digest only
+	Tag    string
+	Digest string
+	// MediaType is the media type of the manifest
+	MediaType string
+	// Manifest is the path of the manifest content
+	Manifest string
+	// Blobs are the paths of the config and the layers keyed by the digests
+	Blobs map[string]string
+}
+
+// Registry serves the images and the blobs, it is read-only.
+type Registry struct {
+	repos map[string]*repository
+	// names is the sorted names of the repositories
+	names []string
+
+	username string
+	password string
+}
+
+type repository struct {
+	tags      map[string]Image
+	manifests map[string]Image
+	// blobs are the blobs of the images of the repository, a blob is served
+	// only by the repositories of its images
+	blobs map[string]string
+}
+
+// New returns a registry of the images. The manifests of the images are served
+// as blobs too.
+func New(images []Image) *Registry {
+	r := &Registry{repos: make(map[string]*repository)}
+	for _, i := range images {
+		repo, ok := r.repos[i.Name]
+		if !ok {
+			repo = &repository{tags: make(map[string]Image), manifests: make(map[string]Image), blobs: make(map[string]string)}
+			r.repos[i.Name] = repo
+			r.names = append(r.names, i.Name)
+		}
+		if i.Tag != "" {
+			repo.tags[i.Tag] = i
+		}
+		repo.manifests[i.Digest] = i
+		for d, p := range i.Blobs {
+			repo.blobs[d] = p
+		}
+		repo.blobs[i.Digest] = i.Manifest
+	}
+	sort.Strings(r.names)
+	return r
+}
+
+// SetBasicAuth requires the basic auth credential for every request.
+func (r *Registry) SetBasicAuth(username, password string) {
+	r.username = username
+	r.password = password
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set(_apiVersionKey, _apiVersion)
+	if r.username != "" && !r.authorized(req) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="lighting"`)
+		writeError(w, http.StatusUnauthorized, "UNAUTHORIZED", "authentication required")
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "the registry is read-only")
+		return
+	}
+
+	p := req.URL.Path
+	switch {
+	case p == "/v2/" || p == "/v2":
+		w.WriteHeader(http.StatusOK)
+		return
+	case p == "/v2/_catalog":
+		r.serveList(w, req, r.names, func(items []string) interface{} {
+			return struct {
+				Repositories []string `json:"repositories"`
+			}{items}
+		})
+		return
+	case !strings.HasPrefix(p, "/v2/"):
+		writeError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+	p = strings.TrimPrefix(p, "/v2/")
+	if strings.HasSuffix(p, "/tags/list") {
+		name := strings.TrimSuffix(p, "/tags/list")
+		r.serveTags(w, req, name)
+		return
+	}
+	for _, kind := range []string{"/manifests/", "/blobs/"} {
+		i := strings.LastIndex(p, kind)
+		if i <= 0 {
+			continue
+		}
+		name, ref := p[:i], p[i+len(kind):]
+		repo, ok := r.repos[name]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %s is not known", name))
+			return
+		}
+		if kind == "/manifests/" {
+			r.serveManifest(w, req, repo, ref)
+		} else {
+			r.serveBlob(w, req, repo, ref)
+		}
+		return
+	}
+	writeError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+}
+
+func (r *Registry) authorized(req *http.Request) bool {
+	user, password, ok := req.BasicAuth()
+	return ok && subtle.ConstantTimeCompare([]byte(user), []byte(r.username)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(r.password)) == 1
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo *repository, ref string) {
+	image, ok := repo.tags[ref]
+	if !ok {
+		image, ok = repo.manifests[ref]
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("manifest %s is not known", ref))
+		return
+	}
+	w.Header().Set("Content-Type", image.MediaType)
+	w.Header().Set(_digestKey, image.Digest)
+	serveFile(w, req, image.Manifest)
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, repo *repository, digest string) {
+	path, ok := repo.blobs[digest]
+	if !ok {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", fmt.Sprintf("blob %s is not known", digest))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(_digestKey, digest)
+	serveFile(w, req, path)
+}
+
+// serveFile serves the content of the file, http.ServeContent handles HEAD,
+// Range and the conditional requests.
+func serveFile(w http.ResponseWriter, req *http.Request, path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "BLOB_UNKNOWN", "the content is not found")
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	http.ServeContent(w, req, "", fi.ModTime(), f)
+}
+
+func (r *Registry) serveTags(w http.ResponseWriter, req *http.Request, name string) {
+	repo, ok := r.repos[name]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %s is not known", name))
+		return
+	}
+	tags := make([]string, 0, len(repo.tags))
+	for t := range repo.tags {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	r.serveList(w, req, tags, func(items []string) interface{} {
+		return struct {
+			Name string   `json:"name"`
+			Tags []string `json:"tags"`
+		}{name, items}
+	})
+}
+
+// serveList serves a page of the sorted items after the query parameter last,
+// with at most n items. The Link header of the next page is set if there are
+// more items, n=0 gets an empty page without the Link header.
+func (r *Registry) serveList(w http.ResponseWriter, req *http.Request, items []string, body func([]string) interface{}) {
+	q := req.URL.Query()
+	n := _defaultPage
+	if v := q.Get("n"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			writeError(w, http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", fmt.Sprintf("invalid n %q", v))
+			return
+		}
+		n = i
+	}
+	// an empty page has no next page, the last item of the page is required
+	// by the Link header
+	if n == 0 {
+		writeJSON(w, http.StatusOK, body([]string{}))
+		return
+	}
+	start := 0
+	if last := q.Get("last"); last != "" {
+		start = sort.Search(len(items), func(i int) bool { return items[i] > last })
+	}
+	end := len(items)
+	if start+n < end {
+		end = start + n
+		next := url.Values{"n": {strconv.Itoa(n)}, "last": {items[end-1]}}
+		w.Header().Set("Link", fmt.Sprintf(`<%s?%s>; rel="next"`, req.URL.Path, next.Encode()))
+	}
+	page := items[start:end]
+	if page == nil {
+		page = []string{}
+	}
+	writeJSON(w, http.StatusOK, body(page))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, struct {
+		Errors []apiError `json:"errors"`
+	}{[]apiError{{code, message}}})
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	_manifestDigest = "sha256:0000000000000000000000000000000000000000000000000000000000000001"
+	_layerDigest    = "sha256:0000000000000000000000000000000000000000000000000000000000000002"
+)
+
+func newTestRegistry(t *testing.T) (*httptest.Server, func()) {
+	dir, err := ioutil.TempDir("", "lighting-serve")
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	manifest := filepath.Join(dir, "1.manifest.json")
+	layer := filepath.Join(dir, "2.tar.gz")
+	_ = ioutil.WriteFile(manifest, []byte(`{"schemaVersion":2}`), 0644)
+	_ = ioutil.WriteFile(layer, []byte("0123456789"), 0644)
+	var images []Image
+	for i := 0; i < 3; i++ {
+		images = append(images, Image{Name: "shipengqi/apiserver", Tag: fmt.Sprintf("1.5.%d", i), Digest: _manifestDigest,
+			MediaType: "application/vnd.docker.distribution.manifest.v2+json", Manifest: manifest})
+	}
+	images = append(images, Image{Name: "coreos/etcd", Digest: _manifestDigest, MediaType: "application/vnd.oci.image.manifest.v1+json", Manifest: manifest,
+		Blobs: map[string]string{_layerDigest: layer}})
+	s := httptest.NewServer(New(images))
+	return s, func() {
+		s.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	s, cleanup := newTestRegistry(t)
+	defer cleanup()
+
+	get := func(method, path string, header map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(method, s.URL+path, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res, string(body)
+	}
+
+	t.Run("Version check", func(t *testing.T) {
+		res, _ := get(http.MethodGet, "/v2/", nil)
+		if res.StatusCode != http.StatusOK || res.Header.Get(_apiVersionKey) != _apiVersion {
+			t.Fatalf("Wanted 200 %s, got %d %s", _apiVersion, res.StatusCode, res.Header.Get(_apiVersionKey))
+		}
+	})
+
+	t.Run("Manifest by tag and digest", func(t *testing.T) {
+		for _, ref := range []string{"1.5.1", _manifestDigest} {
+			res, body := get(http.MethodGet, "/v2/shipengqi/apiserver/manifests/"+ref, nil)
+			if res.StatusCode != http.StatusOK || body != `{"schemaVersion":2}` || res.Header.Get(_digestKey) != _manifestDigest {
+				t.Fatalf("Wanted the manifest, got %d %s", res.StatusCode, body)
+			}
+			if ct := res.Header.Get("Content-Type"); ct != "application/vnd.docker.distribution.manifest.v2+json" {
+				t.Fatalf("Wanted the manifest media type, got %s", ct)
+			}
+		}
+		res, _ := get(http.MethodHead, "/v2/coreos/etcd/manifests/"+_manifestDigest, nil)
+		if res.StatusCode != http.StatusOK || res.ContentLength != int64(len(`{"schemaVersion":2}`)) {
+			t.Fatalf("Wanted 200, got %d, length %d", res.StatusCode, res.ContentLength)
+		}
+		if res, _ = get(http.MethodGet, "/v2/shipengqi/apiserver/manifests/missing", nil); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Wanted 404, got %d", res.StatusCode)
+		}
+		if res, _ = get(http.MethodGet, "/v2/missing/manifests/1.5.1", nil); res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Wanted 404, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("Blob with range", func(t *testing.T) {
+		res, body := get(http.MethodGet, "/v2/coreos/etcd/blobs/"+_layerDigest, nil)
+		if res.StatusCode != http.StatusOK || body != "0123456789" {
+			t.Fatalf("Wanted the blob, got %d %s", res.StatusCode, body)
+		}
+		res, body = get(http.MethodGet, "/v2/coreos/etcd/blobs/"+_layerDigest, map[string]string{"Range": "bytes=4-"})
+		if res.StatusCode != http.StatusPartialContent || body != "456789" {
+			t.Fatalf("Wanted 206 456789, got %d %s", res.StatusCode, body)
+		}
+	})
+
+	t.Run("Blob of another repository", func(t *testing.T) {
+		res, _ := get(http.MethodGet, "/v2/shipengqi/apiserver/blobs/"+_layerDigest, nil)
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Wanted 404, got %d", res.StatusCode)
+		}
+		if res, _ = get(http.MethodHead, "/v2/shipengqi/apiserver/blobs/"+_manifestDigest, nil); res.StatusCode != http.StatusOK {
+			t.Fatalf("Wanted 200, got %d", res.StatusCode)
+		}
+	})
+
+	t.Run("Paginated tags and catalog", func(t *testing.T) {
+		res, body := get(http.MethodGet, "/v2/shipengqi/apiserver/tags/list?n=2", nil)
+		tags := struct {
+			Tags []string `json:"tags"`
+		}{}
+		_ = json.Unmarshal([]byte(body), &tags)
+		if len(tags.Tags) != 2 || res.Header.Get("Link") != `</v2/shipengqi/apiserver/tags/list?last=1.5.1&n=2>; rel="next"` {
+			t.Fatalf("Wanted 2 tags and the next link, got %v %s", tags.Tags, res.Header.Get("Link"))
+		}
+		res, body = get(http.MethodGet, "/v2/shipengqi/apiserver/tags/list?n=2&last=1.5.1", nil)
+		_ = json.Unmarshal([]byte(body), &tags)
+		if len(tags.Tags) != 1 || tags.Tags[0] != "1.5.2" || res.Header.Get("Link") != "" {
+			t.Fatalf("Wanted [1.5.2], got %v", tags.Tags)
+		}
+		_, body = get(http.MethodGet, "/v2/_catalog", nil)
+		if body != `{"repositories":["coreos/etcd","shipengqi/apiserver"]}`+"\n" {
+			t.Fatalf("Wanted the catalog, got %s", body)
+		}
+	})
+
+	emptyPages := []struct {
+		path     string
+		expected string
+	}{
+		{"/v2/_catalog?n=0", `{"repositories":[]}`},
+		{"/v2/shipengqi/apiserver/tags/list?n=0", `{"name":"shipengqi/apiserver","tags":[]}`},
+		{"/v2/shipengqi/apiserver/tags/list?last=1.5.1&n=0", `{"name":"shipengqi/apiserver","tags":[]}`},
+	}
+	for _, v := range emptyPages {
+		t.Run("Empty page "+v.path, func(t *testing.T) {
+			res, body := get(http.MethodGet, v.path, nil)
+			if res.StatusCode != http.StatusOK || body != v.expected+"\n" || res.Header.Get("Link") != "" {
+				t.Fatalf("Wanted %s without the next link, got %d %s %s", v.expected, res.StatusCode, body, res.Header.Get("Link"))
+			}
+		})
+	}
+
+	t.Run("Read-only", func(t *testing.T) {
+		if res, _ := get(http.MethodPut, "/v2/coreos/etcd/manifests/latest", nil); res.StatusCode != http.StatusMethodNotAllowed {
+			t.Fatalf("Wanted 405, got %d", res.StatusCode)
+		}
+	})
+}
+
+func TestBasicAuth(t *testing.T) {
+	r := New(nil)
+	r.SetBasicAuth("admin", "secret")
+	s := httptest.NewServer(r)
+	defer s.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, s.URL+"/v2/", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("Wanted 401, got %d", res.StatusCode)
+	}
+	req.SetBasicAuth("admin", "secret")
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	_ = res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Wanted 200, got %d", res.StatusCode)
+	}
+}
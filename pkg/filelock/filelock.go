@@ -1,32 +1,223 @@
+// Package filelock implements the process locks of lighting. A lock is a file
+// locked by flock(2) (LockFileEx on windows), the lock is released by the
+// kernel when the process exits, so the lock file left by a crashed process
+// does not block the later runs. The owner of the lock is written into the
+// lock file.
 package filelock
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Owner is the process holding a lock.
+type Owner struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Start time.Time `json:"start"`
+}
+
+func (o *Owner) String() string {
+	return fmt.Sprintf("pid %d on %s since %s", o.PID, o.Host, o.Start.Format(time.RFC3339))
+}
+
+// LockedError is returned if the lock is held by another process, or by
+// another lock of this process.
+type LockedError struct {
+	Name string
+	// Owner is the owner written in the lock file, it is nil if the owner
+	// has not been written yet
+	Owner *Owner
+}
 
-	"github.com/shipengqi/lighting-i/pkg/utils"
+func (e *LockedError) Error() string {
+	if e.Owner == nil {
+		return fmt.Sprintf("%s is locked by another process", e.Name)
+	}
+	return fmt.Sprintf("%s is locked by %s", e.Name, e.Owner)
+}
+
+// _retryInterval is the interval of the retries of LockWait.
+const _retryInterval = 500 * time.Millisecond
+
+var (
+	errWouldBlock = errors.New("the file is locked")
+	// errNotSupported is returned if the file system does not support the
+	// file locks, e.g. some NFS mounts
+	errNotSupported = errors.New("the file lock is not supported")
 )
 
-func Check(name string) bool {
-	return utils.PathIsExist(name)
+var (
+	mu   sync.Mutex
+	held = make(map[string]*os.File)
+	// self is the owner of the locks of this process
+	self = &Owner{PID: os.Getpid(), Host: hostname(), Start: time.Now()}
+)
+
+func hostname() string {
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
 }
 
+// Lock acquires the lock of the file name without waiting, it returns a
+// *LockedError if the lock is held.
 func Lock(name string) error {
-	if Check(name) {
-		return fmt.Errorf("lock exists")
+	return LockWait(name, 0)
+}
+
+// LockWait acquires the lock of the file name, if the lock is held, it retries
+// until the lock is released or wait is elapsed.
+func LockWait(name string, wait time.Duration) error {
+	deadline := time.Now().Add(wait)
+	for {
+		err := tryLock(name)
+		if _, ok := err.(*LockedError); !ok {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if remaining > _retryInterval {
+			remaining = _retryInterval
+		}
+		time.Sleep(remaining)
 	}
-	f, err := os.Create(name)
+}
+
+func tryLock(name string) error {
+	name = filepath.Clean(name)
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := held[name]; ok {
+		return &LockedError{Name: name, Owner: self}
+	}
+	for {
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		err = lockFile(f)
+		if err == errNotSupported {
+			// fall back to the owner of the lock file, the lock is held if
+			// the process of the owner is running
+			if owner, err := ReadOwner(name); err == nil && ownerAlive(owner) {
+				_ = f.Close()
+				return &LockedError{Name: name, Owner: owner}
+			}
+		} else if err != nil {
+			_ = f.Close()
+			if err == errWouldBlock {
+				owner, _ := ReadOwner(name)
+				return &LockedError{Name: name, Owner: owner}
+			}
+			return err
+		}
+		// the file is removed by the previous owner after it is opened, the
+		// lock of the removed file is useless
+		if !isLockedFile(f, name) {
+			_ = unlockFile(f)
+			_ = f.Close()
+			continue
+		}
+		if err = writeOwner(f); err != nil {
+			_ = unlockFile(f)
+			_ = f.Close()
+			return err
+		}
+		held[name] = f
+		return nil
+	}
+}
+
+// ownerAlive reports whether the process of the owner is running, the
+// processes of the other hosts are supposed to be running.
+func ownerAlive(owner *Owner) bool {
+	return owner.Host != self.Host || processAlive(owner.PID)
+}
+
+func isLockedFile(f *os.File, name string) bool {
+	fi, err := f.Stat()
 	if err != nil {
-		return err
+		return false
+	}
+	ni, err := os.Stat(name)
+	if err != nil {
+		return false
 	}
-	defer f.Close()
-	return nil
+	return os.SameFile(fi, ni)
 }
 
-func UnLock(name string) error {
-	err := os.Remove(name)
+func writeOwner(f *os.File) error {
+	data, err := json.Marshal(self)
 	if err != nil {
 		return err
 	}
-	return nil
-}
\ No newline at end of file
+	if err = f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err = f.WriteAt(data, 0); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// ReadOwner returns the owner written in the lock file.
+func ReadOwner(name string) (*Owner, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	owner := &Owner{}
+	if err = json.Unmarshal(data, owner); err != nil {
+		return nil, fmt.Errorf("%s has no owner: %v", name, err)
+	}
+	return owner, nil
+}
+
+// Check reports whether the lock of the file name is held by a process. The
+// owner written in the lock file is checked instead of locking the file, a
+// check does not make a concurrent Lock fail.
+func Check(name string) bool {
+	name = filepath.Clean(name)
+	mu.Lock()
+	_, ok := held[name]
+	mu.Unlock()
+	if ok {
+		return true
+	}
+	owner, err := ReadOwner(name)
+	return err == nil && ownerAlive(owner)
+}
+
+// Stale returns the owner of the lock file left by a process which is not
+// running anymore, e.g. a crashed process. The stale lock is recovered by Lock.
+func Stale(name string) (*Owner, bool) {
+	owner, err := ReadOwner(name)
+	if err != nil || Check(name) {
+		return nil, false
+	}
+	return owner, true
+}
+
+// UnLock releases the lock of the file name and removes the lock file.
+func UnLock(name string) error {
+	name = filepath.Clean(name)
+	mu.Lock()
+	defer mu.Unlock()
+	f, ok := held[name]
+	if !ok {
+		return fmt.Errorf("%s is not locked", name)
+	}
+	delete(held, name)
+	return removeLockFile(f, name)
+}
@@ -1,6 +1,15 @@
 package filelock
 
-import "testing"
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
 
 func TestLock(t *testing.T) {
 	lockfile := "test.lock"
@@ -37,4 +46,181 @@ func TestUnLock(t *testing.T) {
 			t.Fatal("Wanted false, got true")
 		}
 	})
-}
\ No newline at end of file
+}
+func TestOwner(t *testing.T) {
+	lockfile := "test.owner.lock"
+	if err := Lock(lockfile); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	defer UnLock(lockfile)
+	owner, err := ReadOwner(lockfile)
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	if owner.PID != os.Getpid() || owner.Host != self.Host {
+		t.Fatalf("Wanted pid %d on %s, got %s", os.Getpid(), self.Host, owner)
+	}
+	if !Check(lockfile) {
+		t.Fatal("Wanted true, got false")
+	}
+}
+
+func TestStaleLock(t *testing.T) {
+	lockfile := "test.stale.lock"
+	defer os.Remove(lockfile)
+	// the lock file left by a crashed process
+	dead := &Owner{PID: 1 << 22, Host: self.Host, Start: time.Now().Add(-time.Hour)}
+	data, _ := json.Marshal(dead)
+	if err := ioutil.WriteFile(lockfile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Detect the stale lock", func(t *testing.T) {
+		if Check(lockfile) {
+			t.Fatal("Wanted false, got true")
+		}
+		owner, ok := Stale(lockfile)
+		if !ok || owner.PID != dead.PID {
+			t.Fatalf("Wanted pid %d, got %v", dead.PID, owner)
+		}
+	})
+
+	t.Run("Recover the stale lock", func(t *testing.T) {
+		if err := Lock(lockfile); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		defer UnLock(lockfile)
+		if _, ok := Stale(lockfile); ok {
+			t.Fatal("Wanted false, got true")
+		}
+	})
+}
+
+// TestHelperProcess holds the lock in a child process, it is not a real test.
+func TestHelperProcess(t *testing.T) {
+	if lockfile := os.Getenv("LIGHTING_TEST_CHECK"); lockfile != "" {
+		checkLoop(lockfile)
+	}
+	lockfile := os.Getenv("LIGHTING_TEST_LOCK")
+	if lockfile == "" {
+		return
+	}
+	if err := Lock(lockfile); err != nil {
+		os.Exit(2)
+	}
+	fmt.Println("locked")
+	hold, _ := time.ParseDuration(os.Getenv("LIGHTING_TEST_HOLD"))
+	time.Sleep(hold)
+	// exit without unlocking, as a crashed process
+	os.Exit(0)
+}
+
+// checkLoop checks the lock until the stdin is closed, as a gc run.
+func checkLoop(lockfile string) {
+	fmt.Println("checking")
+	closed := make(chan struct{})
+	go func() {
+		_, _ = ioutil.ReadAll(os.Stdin)
+		close(closed)
+	}()
+	for {
+		select {
+		case <-closed:
+			os.Exit(0)
+		default:
+			Check(lockfile)
+		}
+	}
+}
+
+// lockInChild starts a child process holding the lock for hold, it returns
+// after the lock is acquired.
+func lockInChild(t *testing.T, lockfile string, hold time.Duration) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+	cmd.Env = append(os.Environ(), "LIGHTING_TEST_LOCK="+lockfile, "LIGHTING_TEST_HOLD="+hold.String())
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(out).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("Wanted locked, got %q, %v", line, err)
+	}
+	return cmd
+}
+
+func TestLockHeldByAnotherProcess(t *testing.T) {
+	lockfile := "test.process.lock"
+	defer os.Remove(lockfile)
+
+	t.Run("Lock failed", func(t *testing.T) {
+		cmd := lockInChild(t, lockfile, 500*time.Millisecond)
+		defer cmd.Wait()
+		err := Lock(lockfile)
+		le, ok := err.(*LockedError)
+		if !ok {
+			t.Fatalf("Wanted *LockedError, got %v", err)
+		}
+		if le.Owner == nil || le.Owner.PID != cmd.Process.Pid {
+			t.Fatalf("Wanted pid %d, got %v", cmd.Process.Pid, le.Owner)
+		}
+		if !Check(lockfile) {
+			t.Fatal("Wanted true, got false")
+		}
+	})
+
+	t.Run("Wait for the lock", func(t *testing.T) {
+		cmd := lockInChild(t, lockfile, 300*time.Millisecond)
+		defer cmd.Wait()
+		if err := LockWait(lockfile, 5*time.Second); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if err := UnLock(lockfile); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+	})
+
+	t.Run("Check does not block the lock", func(t *testing.T) {
+		cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+		cmd.Env = append(os.Environ(), "LIGHTING_TEST_CHECK="+lockfile)
+		in, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Wait()
+		defer in.Close()
+		if line, err := bufio.NewReader(out).ReadString('\n'); err != nil || line != "checking\n" {
+			t.Fatalf("Wanted checking, got %q, %v", line, err)
+		}
+		for i := 0; i < 1000; i++ {
+			if err = Lock(lockfile); err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			if err = UnLock(lockfile); err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+		}
+	})
+
+	t.Run("Wait timeout", func(t *testing.T) {
+		cmd := lockInChild(t, lockfile, time.Second)
+		defer cmd.Wait()
+		start := time.Now()
+		if _, ok := LockWait(lockfile, 300*time.Millisecond).(*LockedError); !ok {
+			t.Fatal("Wanted *LockedError, got nil")
+		}
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Fatalf("Wanted 300ms, got %s", elapsed)
+		}
+	})
+}
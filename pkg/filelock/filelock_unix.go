@@ -0,0 +1,42 @@
+//go:build !windows
+// +build !windows
+
+package filelock
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(f *os.File) error {
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		switch err {
+		case syscall.EINTR:
+			continue
+		case syscall.EWOULDBLOCK:
+			return errWouldBlock
+		case syscall.ENOLCK, syscall.EOPNOTSUPP:
+			return errNotSupported
+		}
+		return err
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
+
+// removeLockFile removes the lock file before releasing the lock, so the
+// processes waiting for the lock of the removed file find it is removed.
+func removeLockFile(f *os.File, name string) error {
+	err := os.Remove(name)
+	_ = unlockFile(f)
+	_ = f.Close()
+	return err
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
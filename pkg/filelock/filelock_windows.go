@@ -0,0 +1,57 @@
+package filelock
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// _stillActive is the exit code of a running process.
+const _stillActive = 259
+
+// the locked byte is beyond the owner written in the file, the locked range
+// of a file cannot be read by the other processes
+var lockedRange = windows.Overlapped{Offset: 0xFFFFFFFE, OffsetHigh: 0x7FFFFFFF}
+
+func lockFile(f *os.File) error {
+	ol := lockedRange
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY | windows.LOCKFILE_EXCLUSIVE_LOCK)
+	err := windows.LockFileEx(windows.Handle(f.Fd()), flags, 0, 1, 0, &ol)
+	switch err {
+	case windows.ERROR_LOCK_VIOLATION:
+		return errWouldBlock
+	case windows.ERROR_NOT_SUPPORTED:
+		return errNotSupported
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	ol := lockedRange
+	return windows.UnlockFileEx(windows.Handle(f.Fd()), 0, 1, 0, &ol)
+}
+
+// removeLockFile releases the lock before removing the lock file, an opened
+// file cannot be removed on windows. The file is left if another process
+// opens it.
+func removeLockFile(f *os.File, name string) error {
+	_ = unlockFile(f)
+	if err := f.Close(); err != nil {
+		return err
+	}
+	_ = os.Remove(name)
+	return nil
+}
+
+func processAlive(pid int) bool {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(h)
+	var code uint32
+	if err = windows.GetExitCodeProcess(h, &code); err != nil {
+		return true
+	}
+	return code == _stillActive
+}
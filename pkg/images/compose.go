@@ -0,0 +1,146 @@
+package images
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var composeVarRegexp = regexp.MustCompile(`\$(?:\$|\{([^}]*)\}|([A-Za-z_][A-Za-z0-9_]*))`)
+
+type composeFile struct {
+	Services map[string]struct {
+		Image string      `yaml:"image"`
+		Build interface{} `yaml:"build"`
+	} `yaml:"services"`
+}
+
+// LookupFunc returns the value of the variable and whether it is set.
+type LookupFunc func(name string) (string, bool)
+
+// FromCompose returns the images of the services of a compose v2/v3 file. The
+// variables in the images are interpolated as docker-compose does: $VAR,
+// ${VAR}, ${VAR:-default}, ${VAR-default}, ${VAR:?error}, ${VAR?error} and $$.
+// The services which are built and have no image are ignored. The images
+// without a registry host are qualified with docker.io.
+func FromCompose(r io.Reader, lookup LookupFunc) ([]string, error) {
+	cf := composeFile{}
+	if err := yaml.NewDecoder(r).Decode(&cf); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("yaml unmarshal: %v", err)
+	}
+	var images []string
+	for name, s := range cf.Services {
+		if s.Image == "" {
+			continue
+		}
+		image, err := interpolate(s.Image, lookup)
+		if err != nil {
+			return nil, fmt.Errorf("service %s: %v", name, err)
+		}
+		if ref, err := ParseReference(image); err == nil && ref.Domain == "" {
+			image = _defaultDomain + "/" + image
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// interpolate substitutes the compose variables of the value.
+func interpolate(value string, lookup LookupFunc) (string, error) {
+	var err error
+	result := composeVarRegexp.ReplaceAllStringFunc(value, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		expr := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(m, "${"), "}"), "$")
+		v, e := interpolateVar(expr, lookup)
+		if e != nil && err == nil {
+			err = e
+		}
+		return v
+	})
+	return result, err
+}
+
+func interpolateVar(expr string, lookup LookupFunc) (string, error) {
+	name, op, arg := expr, "", ""
+	for _, o := range []string{":-", ":?", "-", "?"} {
+		if i := strings.Index(expr, o); i > 0 && (op == "" || i < strings.Index(expr, op)) {
+			name, op, arg = expr[:i], o, expr[i+len(o):]
+		}
+	}
+	if !varNameRegexp.MatchString(name) {
+		return "", fmt.Errorf("invalid variable %q", expr)
+	}
+	v, ok := lookup(name)
+	switch op {
+	case ":-":
+		if v == "" {
+			return arg, nil
+		}
+	case "-":
+		if !ok {
+			return arg, nil
+		}
+	case ":?":
+		if v == "" {
+			return "", fmt.Errorf("required variable %s is missing a value: %s", name, arg)
+		}
+	case "?":
+		if !ok {
+			return "", fmt.Errorf("required variable %s is missing a value: %s", name, arg)
+		}
+	}
+	return v, nil
+}
+
+// ReadEnvFile reads the KEY=VALUE lines of a compose env file, the empty lines
+// and the lines starting with '#' are ignored, the quotes around the values
+// are removed.
+func ReadEnvFile(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("read env file: %v", err)
+	}
+	defer f.Close()
+	env := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		key := strings.TrimSpace(kv[0])
+		if len(kv) != 2 || !varNameRegexp.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: invalid line %q", file, n, line)
+		}
+		value := strings.TrimSpace(kv[1])
+		if len(value) > 1 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read env file: %v", err)
+	}
+	return env, nil
+}
+
+// EnvLookup returns a LookupFunc of the environment variables, then the
+// variables of the env file. The environment variables take precedence, as
+// docker-compose does.
+func EnvLookup(env map[string]string) LookupFunc {
+	return func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		v, ok := env[name]
+		return v, ok
+	}
+}
@@ -0,0 +1,71 @@
+package images
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestFromCompose(t *testing.T) {
+	env, err := ReadEnvFile("testdata/compose/.env")
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	want := map[string]string{"SITE_REGISTRY": "quay.io", "UI_TAG": "0.1.0-0036", "SUITE_VERSION": ""}
+	if !reflect.DeepEqual(env, want) {
+		t.Fatalf("Wanted %v, got %v", want, env)
+	}
+
+	t.Run("Interpolate the images", func(t *testing.T) {
+		f, err := os.Open("testdata/compose/docker-compose.yml")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		defer f.Close()
+		got, err := FromCompose(f, EnvLookup(env))
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		sort.Strings(got)
+		want := []string{
+			"docker.io/postgres:11",
+			"docker.io/shipengqi/apiserver:1.5.0-00287",
+			"quay.io/shipengqi/bosun-ui:0.1.0-0036",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Interpolate the variables", func(t *testing.T) {
+		lookup := func(name string) (string, bool) {
+			v, ok := env[name]
+			return v, ok
+		}
+		tests := []struct {
+			value string
+			want  string
+		}{
+			{"apiserver:${SUITE_VERSION:-1.5.0}", "apiserver:1.5.0"},
+			{"apiserver:${SUITE_VERSION-1.5.0}", "apiserver:"},
+			{"$SITE_REGISTRY/bosun-ui:${UI_TAG}", "quay.io/bosun-ui:0.1.0-0036"},
+			{"postgres:${DB_TAG-11}", "postgres:11"},
+			{"$$HOME", "$HOME"},
+		}
+		for _, tt := range tests {
+			got, err := interpolate(tt.value, lookup)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("Wanted %s, got %s", tt.want, got)
+			}
+		}
+		for _, v := range []string{"${SUITE_VERSION:?the version is required}", "${DB_TAG?}", "${1X}"} {
+			if _, err := interpolate(v, lookup); err == nil {
+				t.Fatalf("Wanted error of %s, got nil", v)
+			}
+		}
+	})
+}
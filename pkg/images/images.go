@@ -2,11 +2,14 @@ package images
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"path"
 	"regexp"
+	"sort"
 	"strings"
 
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 )
 
 var (
@@ -15,9 +18,68 @@ var (
 )
 
 type ImageSet struct {
-	OrgName string   `yaml:"org_name"`
-	Version string   `yaml:"version"`
-	Images  []string `yaml:"images"`
+	OrgName string            `yaml:"org_name"`
+	Version string            `yaml:"version"`
+	Vars    map[string]string `yaml:"vars,omitempty"`
+	Include []string          `yaml:"include,omitempty"`
+	Images  []string          `yaml:"images"`
+	// Patterns are the images with the tags selected by the patterns
+	Patterns []Pattern `yaml:"patterns,omitempty"`
+	Groups   []Group   `yaml:"groups,omitempty"`
+	// Entries are the images of the image set, its groups and its includes
+	// with the variables substituted
+	Entries []Entry `yaml:"-"`
+	// Warnings are the problems of the image set which do not fail the loading
+	Warnings []Problem `yaml:"-"`
+}
+
+// NewImageSet returns the image set of the images, the images are normalized,
+// deduplicated and sorted. If org is not empty, the registry and the namespace
+// of every image are dropped, so the images are downloaded from the org.
+func NewImageSet(images []string, org, version string) (*ImageSet, error) {
+	imageSet := &ImageSet{OrgName: org, Version: version}
+	seen := make(map[string]bool)
+	for _, image := range images {
+		ref, err := ParseImageReference(image, "")
+		if err != nil {
+			return nil, err
+		}
+		if org != "" {
+			image = path.Base(ref.Path)
+			if ref.Tag != "" {
+				image += ":" + ref.Tag
+			}
+			if ref.Digest != "" {
+				image += "@" + ref.Digest
+			}
+			if ref, err = ParseImageReference(image, org); err != nil {
+				return nil, err
+			}
+		}
+		if seen[ref.String()] {
+			continue
+		}
+		seen[ref.String()] = true
+		if org == "" {
+			image = ref.String()
+		}
+		imageSet.Images = append(imageSet.Images, image)
+	}
+	sort.Strings(imageSet.Images)
+	return imageSet, nil
+}
+
+// Encode writes the image set as YAML, the header is written as a comment.
+func (s *ImageSet) Encode(w io.Writer, header string) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("yaml marshal: %v", err)
+	}
+	if header != "" {
+		data = append([]byte("# "+header+"\n"), data...)
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 type Image struct {
@@ -25,15 +87,27 @@ type Image struct {
 	Tag  string
 }
 
+// GetImagesFromSet reads and validates the image set, it fails if there is any
+// error found by Lint.
 func GetImagesFromSet(set string) (*ImageSet, error) {
-	imageSet := &ImageSet{}
 	data, err := ioutil.ReadFile(set)
 	if err != nil {
 		return nil, fmt.Errorf("read images set: %v", err)
 	}
-	err = yaml.Unmarshal(data, imageSet)
+	imageSet, problems, err := parseImageSet(set, data)
 	if err != nil {
-		return nil, fmt.Errorf("yaml unmarshal: %v", err)
+		return nil, err
+	}
+	var errs []string
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			errs = append(errs, p.String())
+			continue
+		}
+		imageSet.Warnings = append(imageSet.Warnings, p)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid images set:\n  %s", strings.Join(errs, "\n  "))
 	}
 	return imageSet, nil
 }
@@ -49,20 +123,21 @@ func ParseImage(image, org string) Image {
 	return Image{Name: fmt.Sprintf("%s/%s", org, name), Tag: tag}
 }
 
+// GetImageNameAndTag returns the name and the tag of the image, the digest of
+// the image is dropped. The tag defaults to 'latest'.
 func GetImageNameAndTag(image string) (string, string) {
 	if len(image) < 1 {
 		return "", ""
 	}
-	s := strings.Split(image, ":")
-	if len(s) < 1 {
-		return "", ""
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
 	}
-
-	if len(s) < 2 {
-		return s[0], _defaultImageTag
+	i := strings.LastIndex(image, ":")
+	if i < 0 || i < strings.LastIndex(image, "/") {
+		return image, _defaultImageTag
 	}
 
-	return s[0], s[1]
+	return image[:i], image[i+1:]
 }
 
 func ReplaceImageOrg(name, org string) (string, error) {
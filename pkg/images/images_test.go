@@ -16,8 +16,8 @@ func TestGetImagesFromConfig(t *testing.T) {
 
     t.Run("Got error", func(t *testing.T) {
 		_, err := GetImagesFromSet("./image_set.yaml")
-		want := "read images config"
-		if !strings.Contains(err.Error(), "read images config") {
+		want := "read images set"
+		if !strings.Contains(err.Error(), "read images set") {
 			t.Fatalf("Wanted %v, got %v", want, err)
 		}
 	})
@@ -49,6 +49,29 @@ func TestParseImage(t *testing.T) {
 	})
 }
 
+func TestGetImageNameAndTag(t *testing.T) {
+	tests := []struct {
+		image string
+		name  string
+		tag   string
+	}{
+		{"addnode:1.5.0-002", "addnode", "1.5.0-002"},
+		{"addnode", "addnode", "latest"},
+		{"localhost:5000/addnode", "localhost:5000/addnode", "latest"},
+		{"localhost:5000/addnode:1.5.0", "localhost:5000/addnode", "1.5.0"},
+		{"addnode@sha256:abc", "addnode", "latest"},
+		{"addnode:1.5.0@sha256:abc", "addnode", "1.5.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			name, tag := GetImageNameAndTag(tt.image)
+			if name != tt.name || tag != tt.tag {
+				t.Fatalf("Wanted %s %s, got %s %s", tt.name, tt.tag, name, tag)
+			}
+		})
+	}
+}
+
 func TestReplaceImageOrg(t *testing.T) {
 	t.Run("Replace image org to test", func(t *testing.T) {
 		want := "test/itom-demo-core-tech-config"
@@ -0,0 +1,121 @@
+package images
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v3"
+)
+
+type k8sContainer struct {
+	Image string `yaml:"image"`
+}
+
+type k8sPodSpec struct {
+	Containers          []k8sContainer `yaml:"containers"`
+	InitContainers      []k8sContainer `yaml:"initContainers"`
+	EphemeralContainers []k8sContainer `yaml:"ephemeralContainers"`
+}
+
+type k8sPodTemplate struct {
+	Spec k8sPodSpec `yaml:"spec"`
+}
+
+// k8sObject holds the fields of the objects which have containers: a Pod, a
+// workload with a pod template, or a CronJob.
+type k8sObject struct {
+	Kind string `yaml:"kind"`
+	Spec struct {
+		k8sPodSpec  `yaml:",inline"`
+		Template    k8sPodTemplate `yaml:"template"`
+		JobTemplate struct {
+			Spec struct {
+				Template k8sPodTemplate `yaml:"template"`
+			} `yaml:"spec"`
+		} `yaml:"jobTemplate"`
+	} `yaml:"spec"`
+}
+
+// FromKubernetes returns the images of the containers and the init containers
+// of the Pods, Deployments, StatefulSets, DaemonSets, ReplicaSets, Jobs and
+// CronJobs in the multi-document YAML, e.g. the output of 'helm template'. The
+// other documents are ignored. The images without a registry host are
+// qualified with docker.io, as Kubernetes pulls them from Docker Hub.
+func FromKubernetes(r io.Reader) ([]string, error) {
+	var images []string
+	d := yaml.NewDecoder(r)
+	for i := 1; ; i++ {
+		doc := yaml.Node{}
+		err := d.Decode(&doc)
+		if err == io.EOF {
+			return images, nil
+		}
+		if err == nil && len(doc.Content) > 0 {
+			var found []string
+			found, err = k8sImages(doc.Content[0])
+			images = append(images, found...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("document %d: %v", i, err)
+		}
+	}
+}
+
+// k8sImages returns the images of the object. Only the kinds which have
+// containers are decoded, so the fields of the other objects, e.g. the custom
+// resources, can be of any type.
+func k8sImages(node *yaml.Node) ([]string, error) {
+	kind := mappingValue(node, "kind")
+	if kind == nil {
+		return nil, nil
+	}
+	switch kind.Value {
+	case "Pod", "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job", "CronJob":
+		obj := k8sObject{}
+		if err := node.Decode(&obj); err != nil {
+			return nil, err
+		}
+		return obj.images(), nil
+	case "List":
+		items := mappingValue(node, "items")
+		if items == nil || items.Kind != yaml.SequenceNode {
+			return nil, nil
+		}
+		var images []string
+		for _, item := range items.Content {
+			found, err := k8sImages(item)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, found...)
+		}
+		return images, nil
+	}
+	return nil, nil
+}
+
+func (o k8sObject) images() []string {
+	var spec k8sPodSpec
+	switch o.Kind {
+	case "Pod":
+		spec = o.Spec.k8sPodSpec
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "ReplicationController", "Job":
+		spec = o.Spec.Template.Spec
+	case "CronJob":
+		spec = o.Spec.JobTemplate.Spec.Template.Spec
+	}
+	var images []string
+	for _, containers := range [][]k8sContainer{spec.InitContainers, spec.Containers, spec.EphemeralContainers} {
+		for _, c := range containers {
+			if c.Image == "" {
+				continue
+			}
+			image := c.Image
+			if ref, err := ParseReference(image); err == nil && ref.Domain == "" {
+				image = _defaultDomain + "/" + image
+			}
+			images = append(images, image)
+		}
+	}
+	return images
+}
@@ -0,0 +1,96 @@
+package images
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFromKubernetes(t *testing.T) {
+	t.Run("Find the images of the workloads", func(t *testing.T) {
+		var got []string
+		for _, file := range []string{"testdata/k8s/app.yaml", "testdata/k8s/list.yaml"} {
+			f, err := os.Open(file)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			images, err := FromKubernetes(f)
+			_ = f.Close()
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			got = append(got, images...)
+		}
+		want := []string{
+			"docker.io/shipengqi/image-utils:1.3.0-0016",
+			"docker.io/shipengqi/apiserver:1.5.0-00287",
+			"docker.io/library/nginx:1.17",
+			"quay.io/coreos/etcd:v3.4.3",
+			"docker.io/nginx:1.17",
+			"docker.io/shipengqi/kubernetes-vault:0.8.0-006",
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Ignore the other documents", func(t *testing.T) {
+		docs := []string{
+			"kind: Widget\nspec:\n  template: default\n  containers: 3\n",
+			"kind: Config\nitems: none\n",
+			"- kind: Pod\n- name: nginx\n",
+			"",
+			"kind: Pod\nspec:\n  containers:\n  - image: nginx:1.17\n",
+		}
+		images, err := FromKubernetes(strings.NewReader(strings.Join(docs, "---\n")))
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if want := []string{"docker.io/nginx:1.17"}; !reflect.DeepEqual(images, want) {
+			t.Fatalf("Wanted %v, got %v", want, images)
+		}
+	})
+
+	t.Run("Invalid YAML", func(t *testing.T) {
+		_, err := FromKubernetes(strings.NewReader("kind: Pod\n---\nkind: [\n"))
+		if err == nil || !strings.Contains(err.Error(), "document 2") {
+			t.Fatalf("Wanted document 2 error, got %v", err)
+		}
+	})
+}
+
+func TestNewImageSet(t *testing.T) {
+	images := []string{"docker.io/shipengqi/apiserver:1.5.0-00287", "docker.io/library/nginx:1.17", "quay.io/coreos/etcd:v3.4.3", "docker.io/nginx:1.17"}
+
+	t.Run("Deduplicate the images", func(t *testing.T) {
+		imageSet, err := NewImageSet(images, "", "")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		want := []string{"docker.io/library/nginx:1.17", "docker.io/shipengqi/apiserver:1.5.0-00287", "quay.io/coreos/etcd:v3.4.3"}
+		if !reflect.DeepEqual(imageSet.Images, want) {
+			t.Fatalf("Wanted %v, got %v", want, imageSet.Images)
+		}
+	})
+
+	t.Run("Override the org", func(t *testing.T) {
+		imageSet, err := NewImageSet(images, "mirror", "1.5.0")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		want := []string{"apiserver:1.5.0-00287", "etcd:v3.4.3", "nginx:1.17"}
+		if !reflect.DeepEqual(imageSet.Images, want) {
+			t.Fatalf("Wanted %v, got %v", want, imageSet.Images)
+		}
+		var buf bytes.Buffer
+		if err = imageSet.Encode(&buf, ""); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		want = []string{"org_name: mirror", "version: 1.5.0", "images:", "    - apiserver:1.5.0-00287", "    - etcd:v3.4.3", "    - nginx:1.17", ""}
+		if got := strings.Split(buf.String(), "\n"); !reflect.DeepEqual(got, want) {
+			t.Fatalf("Wanted %v, got %v", want, got)
+		}
+	})
+}
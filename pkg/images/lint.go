@@ -0,0 +1,377 @@
+package images
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is a problem of the image set file found by the validation.
+type Problem struct {
+	File     string
+	Line     int
+	Severity string
+	Message  string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s:%d: %s: %s", p.File, p.Line, p.Severity, p.Message)
+}
+
+// Lint validates the image set file and its includes and returns the problems.
+// Unknown fields, empty entries, undefined variables, bad includes, invalid
+// patterns and malformed references are errors, duplicate images, empty groups and a
+// missing org_name are warnings. It returns an error if the file cannot be
+// read or is not valid YAML.
+func Lint(file string) ([]Problem, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read images set: %v", err)
+	}
+	_, problems, err := parseImageSet(file, data)
+	return problems, err
+}
+
+// HasErrors reports whether any of the problems is an error.
+func HasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type linter struct {
+	file     string
+	problems []Problem
+	seen     map[string]Entry
+	loading  map[string]bool
+	// order is the order of the files being loaded, the problems are sorted
+	// by the files and the lines
+	order   map[string]int
+	entries []Entry
+}
+
+func parseImageSet(file string, data []byte) (*ImageSet, []Problem, error) {
+	l := &linter{seen: make(map[string]Entry), loading: make(map[string]bool), order: make(map[string]int)}
+	imageSet, err := l.load(file, data, scope{vars: make(map[string]string)}, true)
+	if err != nil {
+		return nil, l.problems, err
+	}
+	imageSet.Entries = l.entries
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		if l.problems[i].File != l.problems[j].File {
+			return l.order[l.problems[i].File] < l.order[l.problems[j].File]
+		}
+		return l.problems[i].Line < l.problems[j].Line
+	})
+	return imageSet, l.problems, nil
+}
+
+// load parses an image set file, the images of the file and of its includes
+// are appended to the entries of the linter. The org and the variables of the
+// parent are inherited by the included file.
+func (l *linter) load(file string, data []byte, parent scope, top bool) (*ImageSet, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("yaml unmarshal: %v", err)
+	}
+	prev := l.file
+	l.file = file
+	l.loading[filepath.Clean(file)] = true
+	if _, ok := l.order[file]; !ok {
+		l.order[file] = len(l.order)
+	}
+	defer func() {
+		l.file = prev
+		delete(l.loading, filepath.Clean(file))
+	}()
+
+	imageSet := &ImageSet{}
+	if len(doc.Content) == 0 {
+		l.add(1, SeverityError, "the image set is empty")
+		return imageSet, nil
+	}
+	root := doc.Content[0]
+	l.checkFields(root, reflect.TypeOf(imageSet))
+	if err := root.Decode(imageSet); err != nil {
+		return nil, fmt.Errorf("yaml unmarshal: %v", err)
+	}
+	l.checkImageSet(root, imageSet, parent, top)
+	return imageSet, nil
+}
+
+func (l *linter) add(line int, severity, format string, args ...interface{}) {
+	l.problems = append(l.problems, Problem{File: l.file, Line: line, Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// checkFields reports the keys of the mappings which are not fields of t.
+func (l *linter) checkFields(node *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			ft, ok := fields[key.Value]
+			if !ok {
+				l.add(key.Line, SeverityError, "unknown field %q", key.Value)
+				continue
+			}
+			l.checkFields(value, ft)
+		}
+	case reflect.Slice:
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range node.Content {
+			l.checkFields(item, t.Elem())
+		}
+	}
+}
+
+// yamlFields returns the types of the fields of the struct keyed by the yaml names.
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := strings.Split(f.Tag.Get("yaml"), ",")
+		if tag[0] == "-" || f.PkgPath != "" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+func (l *linter) checkImageSet(root *yaml.Node, imageSet *ImageSet, parent scope, top bool) {
+	s := scope{org: parent.org, vars: make(map[string]string)}
+	for k, v := range parent.vars {
+		s.vars[k] = v
+	}
+	if mappingValue(root, "org_name") != nil {
+		s.org = imageSet.OrgName
+	} else if top {
+		l.add(root.Line, SeverityWarning, "org_name is missing, the images without a registry host are prefixed with %q", _defaultOrgName)
+	}
+	if imageSet.Version != "" {
+		s.vars["VERSION"] = imageSet.Version
+	}
+	if vars := mappingValue(root, "vars"); vars != nil && vars.Kind == yaml.MappingNode {
+		// the variables of the file can refer to the variables of the parent,
+		// the version and the environment, but not to each other
+		base := scope{vars: s.vars}
+		s.vars = make(map[string]string)
+		for k, v := range base.vars {
+			s.vars[k] = v
+		}
+		for i := 0; i+1 < len(vars.Content); i += 2 {
+			key, value := vars.Content[i], vars.Content[i+1]
+			if !varNameRegexp.MatchString(key.Value) {
+				l.add(key.Line, SeverityError, "invalid variable name %q", key.Value)
+				continue
+			}
+			v, err := base.expand(value.Value)
+			if err != nil {
+				l.add(value.Line, SeverityError, "%v", err)
+				continue
+			}
+			s.vars[key.Value] = v
+		}
+	}
+
+	if images := mappingValue(root, "images"); images != nil {
+		l.checkImages(images, s)
+	}
+	if patterns := mappingValue(root, "patterns"); patterns != nil {
+		l.checkPatterns(patterns, s)
+	}
+	if groups := mappingValue(root, "groups"); groups != nil && groups.Kind == yaml.SequenceNode {
+		for _, group := range groups.Content {
+			l.checkGroup(group, s)
+		}
+	}
+	if include := mappingValue(root, "include"); include != nil && include.Kind == yaml.SequenceNode {
+		for _, item := range include.Content {
+			l.checkInclude(item, s)
+		}
+	}
+}
+
+func (l *linter) checkGroup(node *yaml.Node, parent scope) {
+	if node.Kind != yaml.MappingNode {
+		l.add(node.Line, SeverityError, "the group must be a mapping")
+		return
+	}
+	s := parent
+	if org := mappingValue(node, "org_name"); org != nil {
+		s.org = org.Value
+	}
+	if registry := mappingValue(node, "registry"); registry != nil {
+		if err := checkRegistry(registry.Value); err != nil {
+			l.add(registry.Line, SeverityError, "%v", err)
+			return
+		}
+		s.registry = registry.Value
+	}
+	images, patterns := mappingValue(node, "images"), mappingValue(node, "patterns")
+	if (images == nil || len(images.Content) == 0) && (patterns == nil || len(patterns.Content) == 0) {
+		name := ""
+		if n := mappingValue(node, "name"); n != nil {
+			name = n.Value + " "
+		}
+		l.add(node.Line, SeverityWarning, "the group %shas no images", name)
+		return
+	}
+	if images != nil {
+		l.checkImages(images, s)
+	}
+	if patterns != nil {
+		l.checkPatterns(patterns, s)
+	}
+}
+
+func (l *linter) checkInclude(node *yaml.Node, s scope) {
+	if node.Kind != yaml.ScalarNode || strings.TrimSpace(node.Value) == "" {
+		l.add(node.Line, SeverityError, "the include must be a file path")
+		return
+	}
+	file, err := s.expand(strings.TrimSpace(node.Value))
+	if err != nil {
+		l.add(node.Line, SeverityError, "%v", err)
+		return
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(l.file), file)
+	}
+	if l.loading[filepath.Clean(file)] {
+		l.add(node.Line, SeverityError, "include cycle, %s is already being included", file)
+		return
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		l.add(node.Line, SeverityError, "read include: %v", err)
+		return
+	}
+	if _, err := l.load(file, data, s, false); err != nil {
+		l.add(node.Line, SeverityError, "include %s: %v", file, err)
+	}
+}
+
+func (l *linter) checkImages(node *yaml.Node, s scope) {
+	if node.Kind != yaml.SequenceNode {
+		return
+	}
+	for _, item := range node.Content {
+		l.checkImage(item, s)
+	}
+}
+
+func (l *linter) checkImage(node *yaml.Node, s scope) {
+	if node.Kind != yaml.ScalarNode {
+		l.add(node.Line, SeverityError, "the image must be a string")
+		return
+	}
+	image := strings.TrimSpace(node.Value)
+	if image == "" {
+		l.add(node.Line, SeverityError, "the image is empty")
+		return
+	}
+	image, err := s.expand(image)
+	if err != nil {
+		l.add(node.Line, SeverityError, "%v", err)
+		return
+	}
+	entry := Entry{Image: image, OrgName: s.org, Registry: s.registry, File: l.file, Line: node.Line}
+	ref, err := entry.Reference()
+	if err != nil {
+		l.add(node.Line, SeverityError, "%v", err)
+		return
+	}
+	if e, ok := l.seen[ref.String()]; ok {
+		at := fmt.Sprintf("line %d", e.Line)
+		if e.File != l.file {
+			at = fmt.Sprintf("%s:%d", e.File, e.Line)
+		}
+		l.add(node.Line, SeverityWarning, "duplicate image %s, it is defined at %s, the duplicate is ignored", image, at)
+		return
+	}
+	l.seen[ref.String()] = entry
+	l.entries = append(l.entries, entry)
+}
+
+func (l *linter) checkPatterns(node *yaml.Node, s scope) {
+	if node.Kind != yaml.SequenceNode {
+		return
+	}
+	for _, item := range node.Content {
+		l.checkPattern(item, s)
+	}
+}
+
+func (l *linter) checkPattern(node *yaml.Node, s scope) {
+	p := Pattern{}
+	if node.Kind != yaml.MappingNode || node.Decode(&p) != nil {
+		l.add(node.Line, SeverityError, "the pattern must be a mapping of name, regex, semver and latest")
+		return
+	}
+	var err error
+	for _, f := range []*string{&p.Name, &p.Regex, &p.Semver} {
+		if *f, err = s.expand(strings.TrimSpace(*f)); err != nil {
+			l.add(node.Line, SeverityError, "%v", err)
+			return
+		}
+	}
+	if p.Name == "" {
+		l.add(node.Line, SeverityError, "the name of the pattern is empty")
+		return
+	}
+	entry := Entry{Image: p.Name, OrgName: s.org, Registry: s.registry, Pattern: &p, File: l.file, Line: node.Line}
+	if _, err = entry.Reference(); err != nil {
+		l.add(node.Line, SeverityError, "%v", err)
+		return
+	}
+	if ref, _ := ParseReference(p.Name); ref.Tag != "" || ref.Digest != "" {
+		l.add(node.Line, SeverityError, "the name of the pattern %s must not have a tag or a digest", p.Name)
+		return
+	}
+	if err = p.Validate(); err != nil {
+		l.add(node.Line, SeverityError, "%v", err)
+		return
+	}
+	l.entries = append(l.entries, entry)
+}
+
+// mappingValue returns the value of the key of the mapping, or nil if the key
+// is not found.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
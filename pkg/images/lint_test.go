@@ -0,0 +1,54 @@
+package images
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLint(t *testing.T) {
+	t.Run("Sample image set", func(t *testing.T) {
+		problems, err := Lint("../../image_set.yaml")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		want := "../../image_set.yaml:6: warning: duplicate image opensuse-base:15.1-0032, it is defined at line 4"
+		if len(problems) != 1 || !strings.HasPrefix(problems[0].String(), want) {
+			t.Fatalf("Wanted %s, got %v", want, problems)
+		}
+		if HasErrors(problems) {
+			t.Fatal("Wanted false, got true")
+		}
+	})
+
+	t.Run("Invalid image set", func(t *testing.T) {
+		problems, err := Lint("testdata/invalid_set.yaml")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		want := []string{
+			"testdata/invalid_set.yaml:1: warning: org_name is missing",
+			"testdata/invalid_set.yaml:2: error: unknown field \"registry\"",
+			"testdata/invalid_set.yaml:5: error: the image is empty",
+			"testdata/invalid_set.yaml:6: error: invalid name component",
+			"testdata/invalid_set.yaml:8: warning: duplicate image library/addnode:1.5.0-002, it is defined at line 4, the duplicate is ignored",
+		}
+		if len(problems) != len(want) {
+			t.Fatalf("Wanted %d problems, got %v", len(want), problems)
+		}
+		for i, p := range problems {
+			if !strings.HasPrefix(p.String(), want[i]) {
+				t.Fatalf("Wanted %s, got %s", want[i], p)
+			}
+		}
+		if !HasErrors(problems) {
+			t.Fatal("Wanted true, got false")
+		}
+	})
+
+	t.Run("Load invalid image set", func(t *testing.T) {
+		_, err := GetImagesFromSet("testdata/invalid_set.yaml")
+		if err == nil || !strings.Contains(err.Error(), "invalid images set") {
+			t.Fatalf("Wanted invalid images set, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package images
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LockedImage is an image of the image set resolved to its manifest digest.
+type LockedImage struct {
+	// Image is the entry of the image set
+	Image string `yaml:"image"`
+	// Reference is the resolved reference of the entry, without the digest
+	Reference string `yaml:"reference"`
+	Digest    string `yaml:"digest"`
+}
+
+// LockFile records the manifest digests of an image set.
+type LockFile struct {
+	ImageSet string        `yaml:"image_set"`
+	Images   []LockedImage `yaml:"images"`
+}
+
+// LockFileName returns the default lock file of the image set, e.g.
+// image_set.yaml -> image_set.lock.yaml.
+func LockFileName(set string) string {
+	for _, ext := range []string{".yaml", ".yml"} {
+		if strings.HasSuffix(set, ext) {
+			return strings.TrimSuffix(set, ext) + ".lock" + ext
+		}
+	}
+	return set + ".lock.yaml"
+}
+
+func ReadLockFile(file string) (*LockFile, error) {
+	lf := &LockFile{}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read lock file: %v", err)
+	}
+	err = yaml.Unmarshal(data, lf)
+	if err != nil {
+		return nil, fmt.Errorf("yaml unmarshal: %v", err)
+	}
+	return lf, nil
+}
+
+func (lf *LockFile) Write(file string) error {
+	data, err := yaml.Marshal(lf)
+	if err != nil {
+		return fmt.Errorf("yaml marshal: %v", err)
+	}
+	data = append([]byte("# Generated by 'lighting lock', DO NOT EDIT.\n"), data...)
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// Digests returns the digests keyed by the references.
+func (lf *LockFile) Digests() map[string]string {
+	digests := make(map[string]string, len(lf.Images))
+	for _, i := range lf.Images {
+		digests[i.Reference] = i.Digest
+	}
+	return digests
+}
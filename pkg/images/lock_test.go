@@ -0,0 +1,46 @@
+package images
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockFileName(t *testing.T) {
+	tests := map[string]string{
+		"image_set.yaml":     "image_set.lock.yaml",
+		"/tmp/image_set.yml": "/tmp/image_set.lock.yml",
+		"images":             "images.lock.yaml",
+	}
+	for set, want := range tests {
+		t.Run(set, func(t *testing.T) {
+			if got := LockFileName(set); got != want {
+				t.Fatalf("Wanted %v, got %v", want, got)
+			}
+		})
+	}
+}
+
+func TestLockFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lighting-lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "image_set.lock.yaml")
+	lf := &LockFile{ImageSet: "image_set.yaml", Images: []LockedImage{
+		{Image: "addnode:1.5.0-002", Reference: "library/addnode:1.5.0-002", Digest: "sha256:abc"},
+	}}
+	if err := lf.Write(file); err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	got, err := ReadLockFile(file)
+	if err != nil {
+		t.Fatalf("Wanted nil, got %v", err)
+	}
+	want := "sha256:abc"
+	if d := got.Digests()["library/addnode:1.5.0-002"]; d != want {
+		t.Fatalf("Wanted %v, got %v", want, d)
+	}
+}
@@ -0,0 +1,98 @@
+package images
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Pattern selects the tags of an image by a regular expression and/or a semver
+// constraint. The tags are resolved at download time.
+type Pattern struct {
+	Name   string `yaml:"name"`
+	Regex  string `yaml:"regex"`
+	Semver string `yaml:"semver"`
+	// Latest limits the number of the newest matched tags, 0 is unlimited
+	Latest int `yaml:"latest"`
+}
+
+func (p Pattern) String() string {
+	var s []string
+	if p.Regex != "" {
+		s = append(s, fmt.Sprintf("regex %s", p.Regex))
+	}
+	if p.Semver != "" {
+		s = append(s, fmt.Sprintf("semver %s", p.Semver))
+	}
+	if p.Latest > 0 {
+		s = append(s, fmt.Sprintf("latest %d", p.Latest))
+	}
+	return strings.Join(s, ", ")
+}
+
+// Validate checks the regex and the semver constraint of the pattern.
+func (p Pattern) Validate() error {
+	if p.Regex == "" && p.Semver == "" {
+		return fmt.Errorf("the pattern of %s has no regex or semver", p.Name)
+	}
+	if p.Latest < 0 {
+		return fmt.Errorf("invalid latest %d of %s", p.Latest, p.Name)
+	}
+	if p.Regex != "" {
+		if _, err := regexp.Compile(p.Regex); err != nil {
+			return fmt.Errorf("invalid regex of %s: %v", p.Name, err)
+		}
+	}
+	if p.Semver != "" {
+		if _, err := parseConstraint(p.Semver); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Match returns the tags matched by the pattern, the newest first. The tags
+// are ordered as versions, the tags which are not versions are ordered after
+// them in reverse lexical order.
+func (p Pattern) Match(tags []string) ([]string, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	var re *regexp.Regexp
+	if p.Regex != "" {
+		re = regexp.MustCompile(p.Regex)
+	}
+	var c constraint
+	if p.Semver != "" {
+		c, _ = parseConstraint(p.Semver)
+	}
+	var matched []string
+	for _, t := range tags {
+		if re != nil && !re.MatchString(t) {
+			continue
+		}
+		if c != nil {
+			v, err := parseVersion(t)
+			if err != nil || !c.check(v) {
+				continue
+			}
+		}
+		matched = append(matched, t)
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		vi, erri := parseVersion(matched[i])
+		vj, errj := parseVersion(matched[j])
+		switch {
+		case erri == nil && errj == nil:
+			return compareVersions(vi, vj) > 0
+		case erri == nil || errj == nil:
+			return erri == nil
+		}
+		return matched[i] > matched[j]
+	})
+	if p.Latest > 0 && len(matched) > p.Latest {
+		matched = matched[:p.Latest]
+	}
+	return matched, nil
+}
@@ -0,0 +1,42 @@
+package images
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatternMatch(t *testing.T) {
+	tags := []string{"latest", "1.4.2-003", "1.5.0-00287", "1.5.0-0099", "1.5.1", "1.6.0-001", "v2.0.0", "v2.1.0", "2.1.0-rc1", "dev"}
+	tests := []struct {
+		name    string
+		pattern Pattern
+		want    []string
+	}{
+		{"Tilde", Pattern{Semver: "~1.5"}, []string{"1.5.1", "1.5.0-00287", "1.5.0-0099"}},
+		{"Wildcard", Pattern{Semver: "1.x"}, []string{"1.6.0-001", "1.5.1", "1.5.0-00287", "1.5.0-0099", "1.4.2-003"}},
+		{"Caret", Pattern{Semver: "^2"}, []string{"v2.1.0", "2.1.0-rc1", "v2.0.0"}},
+		{"Range", Pattern{Semver: ">1.4, <=1.5 || >=2.1"}, []string{"v2.1.0", "2.1.0-rc1", "1.5.1", "1.5.0-00287", "1.5.0-0099"}},
+		{"Regex", Pattern{Regex: `^v\d+`, Latest: 1}, []string{"v2.1.0"}},
+		{"Regex and latest", Pattern{Regex: `^1\.`, Latest: 2}, []string{"1.6.0-001", "1.5.1"}},
+		{"Regex without versions", Pattern{Regex: `^(dev|latest)$`}, []string{"latest", "dev"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.pattern.Match(tags)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("Wanted %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Invalid patterns", func(t *testing.T) {
+		for _, p := range []Pattern{{}, {Regex: "("}, {Semver: "~"}, {Semver: "!=1.5"}, {Semver: "1.x.2"}, {Semver: "1.5", Latest: -1}} {
+			if err := p.Validate(); err == nil {
+				t.Fatalf("Wanted error of %v, got nil", p)
+			}
+		}
+	})
+}
@@ -0,0 +1,147 @@
+package images
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	_defaultDomain       = "docker.io"
+	_legacyDefaultDomain = "index.docker.io"
+	_defaultRegistryURL  = "https://registry-1.docker.io"
+)
+
+// The grammar of the references, see
+// https://github.com/distribution/distribution/blob/main/reference/reference.go
+var (
+	domainRegexp    = regexp.MustCompile(`^(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*(?::[0-9]+)?$`)
+	componentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	tagRegexp       = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	digestRegexp    = regexp.MustCompile(`^[a-z0-9]+(?:[.+_-][a-z0-9]+)*:[a-zA-Z0-9=_-]{32,}$`)
+)
+
+// Reference is an image reference, e.g. quay.io/coreos/etcd:v3.4.3 or
+// quay.io/coreos/etcd:v3.4.3@sha256:<hex>.
+type Reference struct {
+	// Domain is the registry host, it is empty if the reference has no domain
+	Domain string
+	// Path is the repository path, e.g. coreos/etcd
+	Path   string
+	Tag    string
+	Digest string
+}
+
+// Name returns the repository name with the domain.
+func (r Reference) Name() string {
+	if r.Domain == "" {
+		return r.Path
+	}
+	return r.Domain + "/" + r.Path
+}
+
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// Reference returns the digest if it is set, otherwise returns the tag, it is
+// the reference of the manifest to fetch.
+func (r Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+// ParseReference parses an image reference. The first component of the name
+// is the domain if it contains a '.' or a ':', or it is 'localhost'. The
+// references of Docker Hub are normalized, e.g. docker.io/nginx is
+// docker.io/library/nginx. The tag and the digest are empty if the reference
+// has no tag or digest.
+func ParseReference(s string) (Reference, error) {
+	ref := Reference{}
+	if s == "" {
+		return ref, fmt.Errorf("empty reference")
+	}
+	name := s
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !digestRegexp.MatchString(ref.Digest) {
+			return ref, fmt.Errorf("invalid digest %q of %s", ref.Digest, s)
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if !tagRegexp.MatchString(ref.Tag) {
+			return ref, fmt.Errorf("invalid tag %q of %s", ref.Tag, s)
+		}
+	}
+
+	ref.Path = name
+	if i := strings.Index(name, "/"); i > 0 {
+		first := name[:i]
+		if strings.ContainsAny(first, ".:") || first == "localhost" {
+			ref.Domain, ref.Path = first, name[i+1:]
+		}
+	}
+	if ref.Domain != "" && !domainRegexp.MatchString(ref.Domain) {
+		return ref, fmt.Errorf("invalid domain %q of %s", ref.Domain, s)
+	}
+	if ref.Path == "" {
+		return ref, fmt.Errorf("invalid reference %s, the name is empty", s)
+	}
+	for _, c := range strings.Split(ref.Path, "/") {
+		if !componentRegexp.MatchString(c) {
+			return ref, fmt.Errorf("invalid name component %q of %s", c, s)
+		}
+	}
+	if len(ref.Name()) > 255 {
+		return ref, fmt.Errorf("invalid reference %s, the name is longer than 255", s)
+	}
+
+	if ref.Domain == _legacyDefaultDomain {
+		ref.Domain = _defaultDomain
+	}
+	if ref.Domain == _defaultDomain && !strings.Contains(ref.Path, "/") {
+		ref.Path = _defaultOrgName + "/" + ref.Path
+	}
+	return ref, nil
+}
+
+// ParseImageReference parses an entry of the image set. An entry with a domain
+// is a fully-qualified reference. An entry without a domain is on the default
+// registry, its name is prefixed with the org, or with 'library' if there is no
+// org and the name is a single component. The tag defaults to 'latest' if the
+// entry has no digest.
+func ParseImageReference(image, org string) (Reference, error) {
+	ref, err := ParseReference(image)
+	if err != nil {
+		return ref, err
+	}
+	if ref.Domain == "" {
+		if org != "" {
+			ref.Path = org + "/" + ref.Path
+		} else if !strings.Contains(ref.Path, "/") {
+			ref.Path = _defaultOrgName + "/" + ref.Path
+		}
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = _defaultImageTag
+	}
+	return ref, nil
+}
+
+// RegistryURL returns the URL of the registry API of the domain.
+func RegistryURL(domain string) string {
+	if domain == _defaultDomain || domain == _legacyDefaultDomain {
+		return _defaultRegistryURL
+	}
+	return "https://" + domain
+}
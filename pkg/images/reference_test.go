@@ -0,0 +1,58 @@
+package images
+
+import "testing"
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image string
+		org   string
+		want  Reference
+	}{
+		{"addnode:1.5.0-002", "", Reference{"", "library/addnode", "1.5.0-002", ""}},
+		{"addnode", "shipengqi", Reference{"", "shipengqi/addnode", "latest", ""}},
+		{"bitnami/redis:5.0", "", Reference{"", "bitnami/redis", "5.0", ""}},
+		{"quay.io/coreos/etcd:v3.4.3", "shipengqi", Reference{"quay.io", "coreos/etcd", "v3.4.3", ""}},
+		{"gcr.io/distroless/static", "", Reference{"gcr.io", "distroless/static", "latest", ""}},
+		{"localhost:5000/a/b/c:1.0", "", Reference{"localhost:5000", "a/b/c", "1.0", ""}},
+		{"docker.io/nginx:1.17", "", Reference{"docker.io", "library/nginx", "1.17", ""}},
+		{"index.docker.io/bitnami/redis", "", Reference{"docker.io", "bitnami/redis", "latest", ""}},
+		{"busybox@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "", Reference{"", "library/busybox", "", "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}},
+		{"localhost:5000/busybox:1.30@sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "", Reference{"localhost:5000", "busybox", "1.30", "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			ref, err := ParseImageReference(tt.image, tt.org)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			if ref != tt.want {
+				t.Fatalf("Wanted %v, got %v", tt.want, ref)
+			}
+		})
+	}
+
+	invalid := []string{"", "Addnode:1.0", "addnode:", "quay.io/:1.0", "quay.io/coreos/etcd:v3:4", "a//b", "busybox@sha256:abc"}
+	for _, image := range invalid {
+		t.Run("Invalid "+image, func(t *testing.T) {
+			if _, err := ParseImageReference(image, ""); err == nil {
+				t.Fatalf("Wanted error, got nil")
+			}
+		})
+	}
+}
+
+func TestRegistryURL(t *testing.T) {
+	t.Run("Docker Hub", func(t *testing.T) {
+		want := "https://registry-1.docker.io"
+		if got := RegistryURL("docker.io"); got != want {
+			t.Fatalf("Wanted %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Other registry", func(t *testing.T) {
+		want := "https://quay.io"
+		if got := RegistryURL("quay.io"); got != want {
+			t.Fatalf("Wanted %v, got %v", want, got)
+		}
+	})
+}
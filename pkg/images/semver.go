@@ -0,0 +1,261 @@
+package images
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// version is a version parsed from a tag, e.g. v1.5.2 or 1.5.0-00287. The
+// suffix after '-' is ignored by the constraints, it only orders the tags of
+// the same version.
+type version struct {
+	parts  [3]int64
+	suffix string
+}
+
+// parseVersion parses a tag with an optional 'v' prefix and up to three
+// numeric parts, the missing parts are 0. The build metadata after '+' is
+// dropped.
+func parseVersion(tag string) (version, error) {
+	v, n, err := parsePartialVersion(tag)
+	if err != nil {
+		return v, err
+	}
+	if n == 0 {
+		return v, fmt.Errorf("invalid version %q", tag)
+	}
+	return v, nil
+}
+
+// parsePartialVersion parses a version which may end with a wildcard, e.g.
+// 1.5.x or 1.*, it returns the number of the parts specified.
+func parsePartialVersion(s string) (version, int, error) {
+	v := version{}
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "v"), "V")
+	if i := strings.Index(s, "+"); i >= 0 {
+		s = s[:i]
+	}
+	if i := strings.Index(s, "-"); i >= 0 {
+		s, v.suffix = s[:i], s[i+1:]
+	}
+	if s == "" {
+		return v, 0, fmt.Errorf("invalid version %q", s)
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, 0, fmt.Errorf("invalid version %q", s)
+	}
+	n := 0
+	for i, p := range parts {
+		if p == "x" || p == "X" || p == "*" {
+			if i != len(parts)-1 || v.suffix != "" {
+				return v, 0, fmt.Errorf("invalid version %q, the wildcard must be the last part", s)
+			}
+			break
+		}
+		num, err := strconv.ParseInt(p, 10, 64)
+		if err != nil || num < 0 {
+			return v, 0, fmt.Errorf("invalid version %q", s)
+		}
+		v.parts[i] = num
+		n++
+	}
+	return v, n, nil
+}
+
+// compareVersions compares the versions, it returns -1, 0 or 1. The versions
+// are compared by the parts, then by the suffixes: numeric suffixes are
+// compared as numbers, and a version without a suffix is the greatest.
+func compareVersions(a, b version) int {
+	if c := compareParts(a, b); c != 0 {
+		return c
+	}
+	switch {
+	case a.suffix == b.suffix:
+		return 0
+	case a.suffix == "":
+		return 1
+	case b.suffix == "":
+		return -1
+	}
+	an, aerr := strconv.ParseInt(a.suffix, 10, 64)
+	bn, berr := strconv.ParseInt(b.suffix, 10, 64)
+	if aerr == nil && berr == nil && an != bn {
+		if an < bn {
+			return -1
+		}
+		return 1
+	}
+	if a.suffix < b.suffix {
+		return -1
+	}
+	return 1
+}
+
+func compareParts(a, b version) int {
+	for i := range a.parts {
+		if a.parts[i] < b.parts[i] {
+			return -1
+		}
+		if a.parts[i] > b.parts[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+type comparator struct {
+	op string
+	v  version
+}
+
+func (c comparator) check(v version) bool {
+	r := compareParts(v, c.v)
+	switch c.op {
+	case "=":
+		return r == 0
+	case "!=":
+		return r != 0
+	case ">":
+		return r > 0
+	case ">=":
+		return r >= 0
+	case "<":
+		return r < 0
+	case "<=":
+		return r <= 0
+	}
+	return false
+}
+
+// constraint is a semver constraint, the comparators of a set are ANDed and the
+// sets are ORed.
+type constraint [][]comparator
+
+// parseConstraint parses a constraint, e.g. "~1.5", ">=1.4, <1.6", ">= 1.4",
+// "1.5.x", "^2 || ^3". The operators are =, !=, >, >=, <, <=, ~ (patch
+// updates) and ^ (updates which do not change the first non-zero part).
+func parseConstraint(s string) (constraint, error) {
+	var c constraint
+	for _, or := range strings.Split(s, "||") {
+		var set []comparator
+		for _, and := range strings.Split(or, ",") {
+			fields := strings.Fields(and)
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("invalid constraint %q", s)
+			}
+			for i := 0; i < len(fields); i++ {
+				f := fields[i]
+				// the operator separated from its version by spaces
+				if isOperator(f) && i+1 < len(fields) {
+					i++
+					f += fields[i]
+				}
+				cs, err := parseComparator(f)
+				if err != nil {
+					return nil, fmt.Errorf("invalid constraint %q: %v", s, err)
+				}
+				set = append(set, cs...)
+			}
+		}
+		c = append(c, set)
+	}
+	return c, nil
+}
+
+var operators = []string{">=", "<=", "!=", ">", "<", "=", "~", "^"}
+
+func isOperator(s string) bool {
+	for _, o := range operators {
+		if s == o {
+			return true
+		}
+	}
+	return false
+}
+
+func parseComparator(s string) ([]comparator, error) {
+	op := ""
+	for _, o := range operators {
+		if strings.HasPrefix(s, o) {
+			op, s = o, strings.TrimSpace(s[len(o):])
+			break
+		}
+	}
+	if s == "*" || s == "x" || s == "X" {
+		if op != "" && op != "=" && op != ">=" {
+			return nil, fmt.Errorf("invalid comparator %s%s", op, s)
+		}
+		return nil, nil
+	}
+	v, n, err := parsePartialVersion(s)
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, fmt.Errorf("invalid version %q", s)
+	}
+	switch op {
+	case "", "=":
+		if n == 3 {
+			return []comparator{{"=", v}}, nil
+		}
+		return []comparator{{">=", v}, {"<", bump(v, n-1)}}, nil
+	case "!=":
+		if n != 3 {
+			return nil, fmt.Errorf("%s needs a full version", op)
+		}
+		return []comparator{{"!=", v}}, nil
+	case ">":
+		if n == 3 {
+			return []comparator{{">", v}}, nil
+		}
+		return []comparator{{">=", bump(v, n-1)}}, nil
+	case ">=", "<":
+		return []comparator{{op, v}}, nil
+	case "<=":
+		if n == 3 {
+			return []comparator{{"<=", v}}, nil
+		}
+		return []comparator{{"<", bump(v, n-1)}}, nil
+	case "~":
+		if n == 1 {
+			return []comparator{{">=", v}, {"<", bump(v, 0)}}, nil
+		}
+		return []comparator{{">=", v}, {"<", bump(v, 1)}}, nil
+	}
+	// ^
+	i := 2
+	switch {
+	case v.parts[0] > 0 || n == 1:
+		i = 0
+	case v.parts[1] > 0 || n == 2:
+		i = 1
+	}
+	return []comparator{{">=", v}, {"<", bump(v, i)}}, nil
+}
+
+// bump increments the part i of the version and resets the following parts.
+func bump(v version, i int) version {
+	b := version{}
+	copy(b.parts[:i], v.parts[:i])
+	b.parts[i] = v.parts[i] + 1
+	return b
+}
+
+func (c constraint) check(v version) bool {
+	for _, set := range c {
+		ok := true
+		for _, cmp := range set {
+			if !cmp.check(v) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package images
+
+import "testing"
+
+func TestParseConstraint(t *testing.T) {
+	tests := []struct {
+		constraint string
+		version    string
+		want       bool
+	}{
+		{">= 1.4", "1.4.0", true},
+		{">= 1.4", "1.3.9", false},
+		{">= 1.4, < 1.6", "1.5.2", true},
+		{">= 1.4 < 1.6", "1.6.0", false},
+		{"~ 1.5", "1.5.9", true},
+		{"~ 1.5", "1.6.0", false},
+		// || combined with ,
+		{">=1.4, <1.5 || ^2", "1.4.3", true},
+		{">=1.4, <1.5 || ^2", "1.5.0", false},
+		{">=1.4, <1.5 || ^2", "2.9.0", true},
+		{">=1.4, <1.5 || ^2", "3.0.0", false},
+		{"!=1.5.0, 1.5.x || 2", "1.5.0", false},
+		{"!=1.5.0, 1.5.x || 2", "1.5.1", true},
+		{"!=1.5.0, 1.5.x || 2", "2.0.1", true},
+		// the suffixes are ignored by the constraints
+		{">=1.5.0", "1.5.0-rc1", true},
+		{">=1.5.0", "1.5.0+build.7", true},
+		{"=1.5.0", "1.5.0-00287", true},
+		{"<1.5.0", "1.5.0-rc1", false},
+		// wildcards
+		{"*", "0.0.1", true},
+		{">=*", "9.9.9", true},
+		{"1.5.x", "1.5.7", true},
+		{"1.5.x", "1.6.0", false},
+		{"1.*", "1.9.0", true},
+		{"1.*", "2.0.0", false},
+		{"V1.X", "1.2.3", true},
+		{">1.x", "2.0.0", true},
+		{">1.x", "1.9.9", false},
+		{"<=1.5.x", "1.5.9", true},
+		{"<=1.5.x", "1.6.0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.constraint+" "+tt.version, func(t *testing.T) {
+			c, err := parseConstraint(tt.constraint)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			v, err := parseVersion(tt.version)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			if got := c.check(v); got != tt.want {
+				t.Fatalf("Wanted %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	t.Run("Invalid constraints", func(t *testing.T) {
+		for _, s := range []string{"", ">=", ">= ,1.4", "1.4 ||", ">=1.4,", "<*", "~*", "1.x.2", "1.5.x-rc1", "!=1.5", "1.5.0.1", "1.a"} {
+			if _, err := parseConstraint(s); err == nil {
+				t.Fatalf("Wanted error of %q, got nil", s)
+			}
+		}
+	})
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"1.5.0", "1.5.0+build.7", 0},
+		{"1.5.0-rc1", "1.5.0", -1},
+		{"1.5.0-rc1", "1.5.0+build.7", -1},
+		{"1.5.0-rc1+build.7", "1.5.0-rc1", 0},
+		{"1.5.0-0099", "1.5.0-00287", -1},
+		{"1.5.0-rc1", "1.5.0-rc2", -1},
+		{"v1.5.1-rc1", "1.5.0", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" "+tt.b, func(t *testing.T) {
+			a, err := parseVersion(tt.a)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			b, err := parseVersion(tt.b)
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			if got := compareVersions(a, b); got != tt.want {
+				t.Fatalf("Wanted %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package images
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var varRegexp = regexp.MustCompile(`\$\{([^}]*)\}`)
+
+var varNameRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Group is a group of the images of the image set, the images of the group are
+// on its own org and registry.
+type Group struct {
+	Name     string    `yaml:"name"`
+	OrgName  string    `yaml:"org_name"`
+	Registry string    `yaml:"registry"`
+	Images   []string  `yaml:"images"`
+	Patterns []Pattern `yaml:"patterns"`
+}
+
+// Entry is an image of the resolved image set.
+type Entry struct {
+	// Image is the entry of the image set with the variables substituted
+	Image    string
+	OrgName  string
+	Registry string
+	// Pattern is the pattern of the entry, the tags of the entry are resolved
+	// from the tags of the image. Image is the name of the image if the entry
+	// has a pattern.
+	Pattern *Pattern
+	// File and Line are where the entry is defined
+	File string
+	Line int
+}
+
+// Reference parses the entry. An entry without a domain is on the registry of
+// its group, or on the default registry if the group has no registry.
+func (e Entry) Reference() (Reference, error) {
+	ref, err := ParseReference(e.Image)
+	if err != nil {
+		return ref, err
+	}
+	if ref.Domain != "" || e.Registry == "" {
+		return ParseImageReference(e.Image, e.OrgName)
+	}
+	name := e.Image
+	if e.OrgName != "" {
+		name = e.OrgName + "/" + name
+	}
+	return ParseImageReference(e.Registry+"/"+name, "")
+}
+
+func (e Entry) String() string {
+	if e.Pattern != nil {
+		return fmt.Sprintf("%s (%s)", e.Image, e.Pattern)
+	}
+	return e.Image
+}
+
+// WithTag returns the entry of the tag resolved from the pattern of the entry.
+func (e Entry) WithTag(tag string) Entry {
+	r := e
+	r.Image = e.Image + ":" + tag
+	return r
+}
+
+// scope is the org, the registry and the variables of the images of an image
+// set file or a group.
+type scope struct {
+	org      string
+	registry string
+	vars     map[string]string
+}
+
+// expand substitutes ${VAR} in the value. The variables of the image set take
+// precedence over the environment variables.
+func (s scope) expand(value string) (string, error) {
+	var err error
+	expanded := varRegexp.ReplaceAllStringFunc(value, func(v string) string {
+		name := v[2 : len(v)-1]
+		if !varNameRegexp.MatchString(name) {
+			if err == nil {
+				err = fmt.Errorf("invalid variable %q", v)
+			}
+			return v
+		}
+		if val, ok := s.vars[name]; ok {
+			return val
+		}
+		if val, ok := os.LookupEnv(name); ok {
+			return val
+		}
+		if err == nil {
+			err = fmt.Errorf("undefined variable %s", name)
+		}
+		return v
+	})
+	return expanded, err
+}
+
+// checkRegistry checks that the registry is a host, e.g. quay.io or
+// localhost:5000.
+func checkRegistry(registry string) error {
+	ref, err := ParseReference(registry + "/probe")
+	if err != nil || ref.Domain == "" || strings.Contains(registry, "/") {
+		return fmt.Errorf("invalid registry %q, it must be a host, e.g. quay.io", registry)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package images
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestResolveImageSet(t *testing.T) {
+	t.Run("Resolve includes, groups and variables", func(t *testing.T) {
+		imageSet, err := GetImagesFromSet("testdata/product_set.yaml")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		want := []string{
+			"shipengqi/apiserver:1.5.0-00287",
+			"shipengqi/opensuse-base:15.1-0032",
+			"shipengqi/controller:latest",
+			"quay.io/coreos/etcd:v3.4.3",
+			"library/busybox:1.30.0",
+			"prom/prometheus:v1.5.0",
+			"prom/node-exporter:15.1-0032",
+		}
+		if len(imageSet.Entries) != len(want) {
+			t.Fatalf("Wanted %d entries, got %v", len(want), imageSet.Entries)
+		}
+		for i, e := range imageSet.Entries {
+			ref, err := e.Reference()
+			if err != nil {
+				t.Fatalf("Wanted nil, got %v", err)
+			}
+			if ref.String() != want[i] {
+				t.Fatalf("Wanted %s, got %s", want[i], ref)
+			}
+		}
+		if p := imageSet.Entries[2].Pattern; p == nil || p.Semver != "~1.5.0" {
+			t.Fatalf("Wanted semver ~1.5.0, got %v", p)
+		}
+		if f := imageSet.Entries[5].File; f != "testdata/teams/monitoring_set.yaml" {
+			t.Fatalf("Wanted testdata/teams/monitoring_set.yaml, got %s", f)
+		}
+	})
+
+	t.Run("Lint includes", func(t *testing.T) {
+		problems, err := Lint("testdata/cycle_set.yaml")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		want := []string{
+			"testdata/teams/cycle_set.yaml:2: error: include cycle",
+			"testdata/teams/cycle_set.yaml:3: error: read include",
+			"testdata/teams/cycle_set.yaml:5: error: undefined variable UNDEFINED_LIGHTING_VAR",
+		}
+		if len(problems) != len(want) {
+			t.Fatalf("Wanted %d problems, got %v", len(want), problems)
+		}
+		for i, p := range problems {
+			if !strings.HasPrefix(p.String(), want[i]) {
+				t.Fatalf("Wanted %s, got %s", want[i], p)
+			}
+		}
+	})
+}
+
+func TestExpand(t *testing.T) {
+	_ = os.Setenv("LIGHTING_TEST_TAG", "env")
+	defer os.Unsetenv("LIGHTING_TEST_TAG")
+	s := scope{vars: map[string]string{"VERSION": "1.5.0", "LIGHTING_TEST_TAG": "set"}}
+
+	t.Run("Expand variables", func(t *testing.T) {
+		got, err := s.expand("apiserver:${VERSION}-${LIGHTING_TEST_TAG}")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if got != "apiserver:1.5.0-set" {
+			t.Fatalf("Wanted apiserver:1.5.0-set, got %s", got)
+		}
+	})
+
+	t.Run("Expand environment variables", func(t *testing.T) {
+		got, err := scope{}.expand("apiserver:${LIGHTING_TEST_TAG}")
+		if err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if got != "apiserver:env" {
+			t.Fatalf("Wanted apiserver:env, got %s", got)
+		}
+	})
+
+	t.Run("Invalid variables", func(t *testing.T) {
+		for _, v := range []string{"${UNDEFINED_LIGHTING_VAR}", "${1X}"} {
+			if _, err := s.expand(v); err == nil {
+				t.Fatalf("Wanted error of %s, got nil", v)
+			}
+		}
+	})
+}
@@ -2,12 +2,30 @@ package log
 
 import (
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/sirupsen/logrus"
 	prefixed "github.com/x-cray/logrus-prefixed-formatter"
 )
 
+// console is the writer of the messages printed to the console, it is
+// os.Stdout if nil.
+var console io.Writer
+
+// SetConsole sets the writer of the messages printed to the console, e.g.
+// os.Stderr to keep stdout for the JSON progress. nil restores os.Stdout.
+func SetConsole(w io.Writer) {
+	console = w
+}
+
+func out() io.Writer {
+	if console == nil {
+		return os.Stdout
+	}
+	return console
+}
+
 func Init(file string) {
 	logrus.SetFormatter(&prefixed.TextFormatter{
 		DisableSorting: true,
@@ -29,23 +47,23 @@ func Debugf(format string, args ...interface{}) {
 }
 
 func Infof(format string, args ...interface{}) {
-	fmt.Printf(format + "\n", args...)
+	fmt.Fprintf(out(), format + "\n", args...)
 	logrus.Infof(format, args...)
 }
 
 func Warnf(format string, args ...interface{}) {
-	fmt.Printf(format + "\n", args...)
+	fmt.Fprintf(out(), format + "\n", args...)
 	logrus.Warnf(format, args...)
 }
 
 func Errorf(format string, args ...interface{}) {
-	fmt.Printf(format + "\n", args...)
+	fmt.Fprintf(out(), format + "\n", args...)
 	logrus.Errorf(format, args...)
 }
 
 
 func Fatalf(format string, args ...interface{}) {
-	fmt.Printf(format, args...)
+	fmt.Fprintf(out(), format, args...)
 	logrus.Fatalf(format, args...)
 }
 
@@ -54,21 +72,21 @@ func Debug(args ...interface{}) {
 }
 
 func Info(args ...interface{}) {
-	fmt.Println(args...)
+	fmt.Fprintln(out(), args...)
 	logrus.Infoln(args...)
 }
 
 func Warn(args ...interface{}) {
-	fmt.Println(args...)
+	fmt.Fprintln(out(), args...)
 	logrus.Warnln(args...)
 }
 
 func Error(args ...interface{}) {
-	fmt.Println(args...)
+	fmt.Fprintln(out(), args...)
 	logrus.Errorln(args...)
 }
 
 func Fatal(args ...interface{}) {
-	fmt.Println(args...)
+	fmt.Fprintln(out(), args...)
 	logrus.Fatalln(args...)
 }
\ No newline at end of file
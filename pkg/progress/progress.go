@@ -0,0 +1,270 @@
+package progress
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gosuri/uiprogress"
+	"github.com/gosuri/uiprogress/util/strutil"
+	"github.com/mattn/go-isatty"
+
+	"github.com/shipengqi/lighting-i/pkg/utils"
+)
+
+var (
+	_defaultWidth      = 50
+	_defaultTitleWidth = 30
+)
+
+// _barScale is the total of a rendered bar, the bar is advanced per mille, an
+// int of the bytes overflows on the 32-bit platforms.
+const _barScale = 1000
+
+// Output modes of the progress.
+const (
+	// ModeAuto renders bars if stdout is a terminal, otherwise prints plain lines
+	ModeAuto = "auto"
+	// ModeBar renders redrawing bars
+	ModeBar = "bar"
+	// ModePlain prints a line for each bar periodically
+	ModePlain = "plain"
+	// ModeJSON prints a newline-delimited JSON event for each bar periodically
+	ModeJSON = "json"
+	// ModeNone prints nothing
+	ModeNone = "none"
+)
+
+// Out is the writer of the plain and JSON progress.
+var Out io.Writer = os.Stdout
+
+// Interval is the time between two reports of the plain and JSON progress.
+var Interval = 5 * time.Second
+
+var (
+	mode  = ModeBar
+	mu    sync.Mutex
+	bars  []*Bar
+	done  chan struct{}
+	ended chan struct{}
+)
+
+// Event is a JSON progress event.
+type Event struct {
+	Time    time.Time `json:"time"`
+	Event   string    `json:"event"`
+	Title   string    `json:"title"`
+	Current int64     `json:"current"`
+	Total   int64     `json:"total"`
+	Rate    int64     `json:"rate"`
+	ETA     int64     `json:"eta_seconds"`
+}
+
+// Bar is a progress bar measured in bytes.
+type Bar struct {
+	Title    string
+	Total    int64
+	current  int64
+	start    time.Time
+	reported int64
+	finished bool
+	bar      *uiprogress.Bar
+}
+
+// SetMode sets the output mode, it must be called before Start.
+func SetMode(m string) error {
+	switch m {
+	case ModeAuto:
+		mode = ModePlain
+		if isatty.IsTerminal(os.Stdout.Fd()) || isatty.IsCygwinTerminal(os.Stdout.Fd()) {
+			mode = ModeBar
+		}
+	case ModeBar, ModePlain, ModeJSON, ModeNone:
+		mode = m
+	default:
+		return fmt.Errorf("invalid progress mode %q, must be one of auto, bar, plain, json or none", m)
+	}
+	return nil
+}
+
+// Mode returns the output mode.
+func Mode() string {
+	return mode
+}
+
+// Start starts rendering the bars.
+func Start() {
+	switch mode {
+	case ModeBar:
+		uiprogress.Start()
+	case ModePlain, ModeJSON:
+		done = make(chan struct{})
+		ended = make(chan struct{})
+		go report(done, ended)
+	}
+}
+
+// Stop stops rendering the bars and reports the last state of them.
+func Stop() {
+	switch mode {
+	case ModeBar:
+		uiprogress.Stop()
+	case ModePlain, ModeJSON:
+		close(done)
+		<-ended
+		flush(true)
+	}
+	mu.Lock()
+	bars = nil
+	mu.Unlock()
+}
+
+// AddBar adds a bar of total bytes.
+func AddBar(title string, total int64) *Bar {
+	b := &Bar{Title: title, Total: total, start: time.Now(), reported: -1}
+	mu.Lock()
+	bars = append(bars, b)
+	mu.Unlock()
+	if mode != ModeBar {
+		return b
+	}
+	b.bar = uiprogress.AddBar(_barScale)
+	b.bar.Width = _defaultWidth
+	b.bar.PrependFunc(func(*uiprogress.Bar) string {
+		return strutil.Resize(b.Title, uint(_defaultTitleWidth))
+	})
+	b.bar.AppendFunc(func(*uiprogress.Bar) string {
+		return b.String()
+	})
+	return b
+}
+
+// Add advances the bar by n bytes, it is safe for concurrent use.
+func (b *Bar) Add(n int64) {
+	current := atomic.AddInt64(&b.current, n)
+	if b.bar == nil {
+		return
+	}
+	_ = b.bar.Set(b.scaled(current))
+}
+
+// scaled returns the per mille of the current bytes, a bar of zero total is
+// completed.
+func (b *Bar) scaled(current int64) int {
+	if b.Total <= 0 || current >= b.Total {
+		return _barScale
+	}
+	return int(current * _barScale / b.Total)
+}
+
+// Current returns the bytes completed.
+func (b *Bar) Current() int64 {
+	return atomic.LoadInt64(&b.current)
+}
+
+// Rate returns the bytes completed per second.
+func (b *Bar) Rate() float64 {
+	elapsed := time.Since(b.start).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(b.Current()) / elapsed
+}
+
+// ETA returns the estimated time to complete, or -1 if it is unknown.
+func (b *Bar) ETA() time.Duration {
+	rate := b.Rate()
+	left := b.Total - b.Current()
+	if left <= 0 {
+		return 0
+	}
+	if rate <= 0 {
+		return -1
+	}
+	return time.Duration(float64(left)/rate) * time.Second
+}
+
+// String returns the bytes, throughput and ETA of the bar.
+func (b *Bar) String() string {
+	current := b.Current()
+	if current > b.Total {
+		current = b.Total
+	}
+	eta := "--"
+	if d := b.ETA(); d >= 0 {
+		eta = d.Round(time.Second).String()
+	}
+	return fmt.Sprintf("%s/%s %s/s ETA %s",
+		utils.HumanSize(current), utils.HumanSize(b.Total), utils.HumanSize(int64(b.Rate())), eta)
+}
+
+func report(done, ended chan struct{}) {
+	defer close(ended)
+	ticker := time.NewTicker(Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			flush(false)
+		}
+	}
+}
+
+// flush reports the bars changed since the last report, if last is true,
+// every bar is reported as finished.
+func flush(last bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, b := range bars {
+		if b.finished {
+			continue
+		}
+		current := b.Current()
+		event := "progress"
+		if current >= b.Total {
+			event = "done"
+			b.finished = true
+		} else if last {
+			event = "stopped"
+			b.finished = true
+		} else if current == b.reported {
+			continue
+		}
+		b.reported = current
+		if mode == ModeJSON {
+			writeEvent(b, event, current)
+			continue
+		}
+		percent := 100
+		if b.Total > 0 && current < b.Total {
+			percent = int(current * 100 / b.Total)
+		}
+		fmt.Fprintf(Out, "[%s] %s %d%% %s\n", event, b.Title, percent, b.String())
+	}
+}
+
+func writeEvent(b *Bar, event string, current int64) {
+	e := Event{
+		Time:    time.Now(),
+		Event:   event,
+		Title:   b.Title,
+		Current: current,
+		Total:   b.Total,
+		Rate:    int64(b.Rate()),
+		ETA:     int64(b.ETA().Seconds()),
+	}
+	if eta := b.ETA(); eta < 0 {
+		e.ETA = -1
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	fmt.Fprintln(Out, string(data))
+}
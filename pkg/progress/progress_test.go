@@ -0,0 +1,90 @@
+package progress
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSetMode(t *testing.T) {
+	t.Run("Invalid mode", func(t *testing.T) {
+		if err := SetMode("fancy"); err == nil {
+			t.Fatal("Wanted error, got nil")
+		}
+	})
+
+	t.Run("Auto mode without terminal", func(t *testing.T) {
+		if err := SetMode(ModeAuto); err != nil {
+			t.Fatalf("Wanted nil, got %v", err)
+		}
+		if Mode() == ModeAuto {
+			t.Fatal("Wanted auto to be resolved")
+		}
+	})
+}
+
+func TestBarScale(t *testing.T) {
+	_ = SetMode(ModeBar)
+	defer func() {
+		_ = SetMode(ModePlain)
+		bars = nil
+	}()
+	// the bytes of a large image overflow an int on the 32-bit platforms
+	b := AddBar("large:1.0", 5<<30)
+	b.Add(5 << 29)
+	if got := b.bar.Current(); got != 500 {
+		t.Fatalf("Wanted 500, got %d", got)
+	}
+	b.Add(5 << 30)
+	if got := b.bar.Current(); got != _barScale {
+		t.Fatalf("Wanted %d, got %d", _barScale, got)
+	}
+	if got := b.Current(); got != 15<<29 {
+		t.Fatalf("Wanted %d, got %d", int64(15<<29), got)
+	}
+	if got := AddBar("empty:1.0", 0).scaled(0); got != _barScale {
+		t.Fatalf("Wanted %d, got %d", _barScale, got)
+	}
+}
+
+func TestPlainProgress(t *testing.T) {
+	buf := &bytes.Buffer{}
+	Out = buf
+	_ = SetMode(ModePlain)
+	Start()
+	b := AddBar("busybox:1.30", 2048)
+	b.Add(1024)
+	flush(false)
+	b.Add(1024)
+	Stop()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Wanted 2 lines, got %v", lines)
+	}
+	if !strings.HasPrefix(lines[0], "[progress] busybox:1.30 50% 1.0 KB/2.0 KB") {
+		t.Fatalf("Wanted progress line, got %s", lines[0])
+	}
+	if !strings.HasPrefix(lines[1], "[done] busybox:1.30 100%") {
+		t.Fatalf("Wanted done line, got %s", lines[1])
+	}
+}
+
+func TestJSONProgress(t *testing.T) {
+	buf := &bytes.Buffer{}
+	Out = buf
+	_ = SetMode(ModeJSON)
+	Start()
+	b := AddBar("busybox:1.30", 2048)
+	b.Add(512)
+	Stop()
+
+	var e Event
+	if err := json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &e); err != nil {
+		t.Fatalf("Wanted JSON, got %s", buf.String())
+	}
+	if e.Event != "stopped" || e.Current != 512 || e.Total != 2048 {
+		t.Fatalf("Wanted stopped 512/2048, got %+v", e)
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package utils
+
+import "syscall"
+
+// DiskFree returns the bytes available to unprivileged users on the
+// filesystem of p.
+func DiskFree(p string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(p, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
@@ -0,0 +1,8 @@
+package utils
+
+import "errors"
+
+// DiskFree is not supported on windows.
+func DiskFree(p string) (uint64, error) {
+	return 0, errors.New("disk free space is not supported on windows")
+}
@@ -1,6 +1,11 @@
 package utils
 
-import "os"
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
 
 func PathIsExist(p string) bool {
 	if _, err := os.Stat(p); err != nil {
@@ -10,3 +15,45 @@ func PathIsExist(p string) bool {
 	}
 	return true
 }
+
+func IsDir(p string) bool {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return false
+	}
+	return fi.IsDir()
+}
+
+var sizeUnits = []string{"B", "KB", "MB", "GB", "TB", "PB"}
+
+// HumanSize formats bytes with a binary unit, e.g. 1536 -> 1.5 KB.
+func HumanSize(n int64) string {
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(sizeUnits)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%d %s", n, sizeUnits[i])
+	}
+	return fmt.Sprintf("%.1f %s", f, sizeUnits[i])
+}
+
+// ParseSize parses a size such as 512MB, 10G or 1024 (bytes) with binary units.
+func ParseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mul := int64(1)
+	if v != "" {
+		if i := strings.Index("KMGTP", v[len(v)-1:]); i >= 0 {
+			mul = int64(1) << (10 * uint(i+1))
+			v = v[:len(v)-1]
+		}
+	}
+	f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(f * float64(mul)), nil
+}